@@ -1,7 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 
 	"github.com/voyagerstudio/haiku-auth/pkg/api"
 	"github.com/voyagerstudio/haiku-auth/pkg/config"
@@ -9,16 +20,160 @@ import (
 )
 
 func main() {
-	cfg, err := config.DefaultConfig()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("error running migrations: %v", err)
+		}
+		return
+	}
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the API until it receives SIGINT or SIGTERM, then fails
+// readiness checks for the shutdown delay, drains in-flight requests and
+// closes the db
+func run() error {
+	cfg, _, err := config.Load("haiku-auth", os.Args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		return nil
+	}
 	if err != nil {
-		log.Fatalf("error loading config: %v", err)
+		return fmt.Errorf("error loading config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if level, err := log.ParseLevel(cfg.Log.Level); err == nil {
+		log.SetLevel(level)
 	}
 
-	db, err := db.New(cfg.DB.Host, cfg.DB.Port, cfg.DB.User, cfg.DB.Pass, cfg.DB.Database)
+	// Stop waiting for the db too if we're asked to stop before it's up
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	db, err := db.New(ctx, cfg.DB.Options())
+	if err != nil {
+		return fmt.Errorf("error connecting to db: %v", err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Errorf("error closing db: %v", err)
+		}
+	}()
+
+	if cfg.DB.AutoMigrate {
+		if err := autoMigrate(ctx, cfg.DB); err != nil {
+			return err
+		}
+	}
+
+	tokens, err := newTokenIssuer(cfg.Auth)
+	if err != nil {
+		return fmt.Errorf("error creating token issuer: %v", err)
+	}
+
+	srv := api.NewServer(api.ServerOptions{
+		Host:         cfg.API.Host,
+		Port:         cfg.API.Port,
+		ReadTimeout:  cfg.API.ReadTimeout,
+		WriteTimeout: cfg.API.WriteTimeout,
+		RateLimit:    cfg.API.RateLimit,
+		RateBurst:    cfg.API.RateBurst,
+	}, db, tokens)
+	if cfg.API.TLSEnabled() {
+		if err := srv.EnableTLS(tlsOptions(cfg.API)); err != nil {
+			return fmt.Errorf("error enabling tls: %v", err)
+		}
+	}
+
+	// With reload on, every change to the config and secret files is
+	// applied, otherwise only rotated secrets are
+	r := &reloader{conn: db, srv: srv, cfg: cfg}
+	var watcher io.Closer
+	if cfg.Reload {
+		watcher, err = cfg.Watch(r.apply)
+	} else {
+		watcher, err = cfg.WatchSecrets(r.applySecret)
+	}
 	if err != nil {
-		log.Fatalf("error connecting to db: %v", err)
+		return err
 	}
+	defer watcher.Close()
 
-	srv := api.NewServer(cfg.API.Host, cfg.API.Port, db)
-	srv.ListenAndServe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("error serving api: %v", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process immediately
+	stop()
+
+	// Keep serving while readiness fails, so Kubernetes takes the pod out
+	// of its endpoints before the listeners close
+	srv.Drain()
+	delay := r.config().API.ShutdownDelay
+	log.Infof("shutting down, draining for %s", delay)
+	select {
+	case err := <-errs:
+		return fmt.Errorf("error serving api: %v", err)
+	case <-time.After(delay):
+	}
+
+	shutdownTimeout := r.config().API.ShutdownTimeout
+	log.Infof("waiting up to %s for in-flight requests", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error shutting down api: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving api: %v", err)
+	}
+
+	log.Info("shutdown complete")
+	return nil
+}
+
+// autoMigrate applies pending migrations on a connection of its own, so the
+// server's query timeout doesn't cut them or the wait for the migration lock
+// short. A signal during a long migration cancels it, rolling back the
+// migration in progress.
+func autoMigrate(ctx context.Context, cfg *config.DBConfig) error {
+	conn, m, err := openMigrator(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := m.Up(ctx); err != nil {
+		return fmt.Errorf("error running migrations: %v", err)
+	}
+	return nil
+}
+
+// tlsOptions returns the HTTPS settings of a validated api config
+func tlsOptions(cfg *config.APIConfig) api.TLSOptions {
+	opts := api.TLSOptions{
+		CertFile:     cfg.TLSCert,
+		KeyFile:      cfg.TLSKey,
+		MinVersion:   cfg.TLSVersion(),
+		CipherSuites: cfg.CipherSuites(),
+	}
+	if cfg.HTTPRedirectPort != 0 {
+		opts.RedirectAddr = fmt.Sprintf("%s:%d", cfg.Host, cfg.HTTPRedirectPort)
+	}
+	if cfg.TLSClientCA != "" {
+		opts.ClientCAFile = cfg.TLSClientCA
+		opts.Policy = api.ServicePolicy{Services: cfg.Services, Routes: cfg.ServiceRoutes}
+	}
+	return opts
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/config"
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+	"github.com/voyagerstudio/haiku-auth/pkg/db/migrate"
+)
+
+const migrateUsage = "usage: haiku-auth migrate [flags] up|down [steps]|status"
+
+// runMigrate implements the `haiku-auth migrate` subcommand
+func runMigrate(args []string) error {
+	all, args, err := config.Load("haiku-auth migrate", args)
+	if errors.Is(err, pflag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error loading config: %v", err)
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	cfg := all.DB
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, m, err := openMigrator(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch args[0] {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		return m.Down(ctx, steps)
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+}
+
+// openMigrator connects to the db for migrations. The connection has no
+// query timeout, since migrations can legitimately run for a long time and
+// replicas starting together wait on each other's migration lock.
+func openMigrator(ctx context.Context, cfg *config.DBConfig) (*db.Conn, *migrate.Migrator, error) {
+	opts := cfg.Options()
+	opts.QueryTimeout = 0
+	conn, err := db.New(ctx, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to db: %v", err)
+	}
+
+	m, err := migrate.New(conn.DB())
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("error loading migrations: %v", err)
+	}
+	return conn, m, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/api"
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+	"github.com/voyagerstudio/haiku-auth/pkg/config"
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+)
+
+// reloader applies config changes to the running server. The log level,
+// db password, query timeout and pool limits, token settings, rate limits
+// and shutdown delay and timeout change in place; anything else, including
+// the read and write timeouts, only takes effect after a restart.
+type reloader struct {
+	conn *db.Conn
+	srv  *api.Server
+
+	mu  sync.Mutex
+	cfg *config.Config
+}
+
+// config returns the config currently in effect
+func (r *reloader) config() *config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// apply switches the server over to a validated config
+func (r *reloader) apply(next *config.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.cfg
+
+	// Build the new token issuer before changing anything, so a failure
+	// leaves the old config entirely in effect
+	var tokens *auth.TokenIssuer
+	if !reflect.DeepEqual(prev.Auth, next.Auth) {
+		var err error
+		tokens, err = newTokenIssuer(next.Auth)
+		if err != nil {
+			log.Errorf("rejected reloaded config, keeping the old one: %v", err)
+			return
+		}
+	}
+
+	if level, err := log.ParseLevel(next.Log.Level); err == nil {
+		log.SetLevel(level)
+	}
+	r.conn.SetPassword(string(next.DB.Pass))
+	r.conn.SetQueryTimeout(next.DB.QueryTimeout)
+	r.conn.SetPool(next.DB.Pool())
+	r.srv.SetRateLimit(next.API.RateLimit, next.API.RateBurst)
+	if tokens != nil {
+		r.srv.SetTokenIssuer(tokens)
+		log.Info("token issuer updated")
+	}
+	for _, key := range restartRequired(prev, next) {
+		log.Warnf("%s changed, restart to apply it", key)
+	}
+	r.cfg = next
+}
+
+// applySecret applies a rotated secret, for when only secret files are
+// watched rather than the whole config
+func (r *reloader) applySecret(key string, value config.Secret) {
+	next := *r.config()
+	switch key {
+	case "auth.signing_key":
+		a := *next.Auth
+		a.SigningKey = value
+		next.Auth = &a
+	case "db.user":
+		d := *next.DB
+		d.User = string(value)
+		next.DB = &d
+	case "db.password":
+		d := *next.DB
+		d.Pass = value
+		next.DB = &d
+	case "db.dsn":
+		d := *next.DB
+		d.DSN = value
+		next.DB = &d
+	}
+
+	if err := next.Validate(); err != nil {
+		log.Errorf("rejected rotated %s, keeping the old one: %v", key, err)
+		return
+	}
+	r.apply(&next)
+}
+
+// restartRequired lists the settings that differ between two configs but
+// can't change while the server is running
+func restartRequired(prev, next *config.Config) []string {
+	var keys []string
+	check := func(key string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			keys = append(keys, key)
+		}
+	}
+	check("api.host", prev.API.Host, next.API.Host)
+	check("api.port", prev.API.Port, next.API.Port)
+	// http.Server reads its timeouts unsynchronized on every connection
+	check("api.read_timeout", prev.API.ReadTimeout, next.API.ReadTimeout)
+	check("api.write_timeout", prev.API.WriteTimeout, next.API.WriteTimeout)
+	check("api.tls_cert", prev.API.TLSCert, next.API.TLSCert)
+	check("api.tls_key", prev.API.TLSKey, next.API.TLSKey)
+	check("api.tls_min_version", prev.API.TLSMinVersion, next.API.TLSMinVersion)
+	check("api.tls_ciphers", prev.API.TLSCiphers, next.API.TLSCiphers)
+	check("api.http_redirect_port", prev.API.HTTPRedirectPort, next.API.HTTPRedirectPort)
+	check("api.tls_client_ca", prev.API.TLSClientCA, next.API.TLSClientCA)
+	check("api.services", prev.API.Services, next.API.Services)
+	check("api.service_routes", prev.API.ServiceRoutes, next.API.ServiceRoutes)
+	check("db.host", prev.DB.Host, next.DB.Host)
+	check("db.port", prev.DB.Port, next.DB.Port)
+	check("db.database", prev.DB.Database, next.DB.Database)
+	check("db.user", prev.DB.User, next.DB.User)
+	check("db.dsn", prev.DB.DSN, next.DB.DSN)
+	check("db.sslmode", prev.DB.SSLMode, next.DB.SSLMode)
+	check("db.sslrootcert", prev.DB.SSLRootCert, next.DB.SSLRootCert)
+	check("db.sslcert", prev.DB.SSLCert, next.DB.SSLCert)
+	check("db.sslkey", prev.DB.SSLKey, next.DB.SSLKey)
+	check("db.auto_migrate", prev.DB.AutoMigrate, next.DB.AutoMigrate)
+	return keys
+}
+
+// newTokenIssuer creates a token issuer from the auth config
+func newTokenIssuer(cfg *config.AuthConfig) (*auth.TokenIssuer, error) {
+	return auth.NewTokenIssuer(cfg.Algorithm, []byte(cfg.SigningKey), cfg.Issuer, cfg.TokenTTL, cfg.RefreshTTL)
+}
@@ -1,54 +1,194 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
 	"github.com/voyagerstudio/haiku-auth/pkg/db"
+	"github.com/voyagerstudio/haiku-auth/pkg/db/migrate"
 )
 
 const (
-	ParamUser = "user"
-	ParamNote = "note"
+	ParamNote     = "note"
+	ParamTag      = "tag"
+	ParamNotebook = "notebook"
+	ParamRevision = "revision"
 )
 
 // Server is a wrapper type for the general HTTP server
 // We'll be adding things in here like references to a database
 type Server struct {
 	srv *http.Server
-	db  *db.Conn
+	// certs, if set, serves srv over HTTPS, and redirect, if set, sends
+	// plain HTTP requests there, see EnableTLS
+	certs    *certReloader
+	redirect *http.Server
+	router   *mux.Router
+
+	// services maps client certificate names to service identities, and
+	// serviceRoutes limits routes to sets of services, see ServicePolicy
+	services      map[string]string
+	serviceRoutes map[string]map[string]bool
+
+	db db.Store
+	// tokens holds the current *auth.TokenIssuer, see SetTokenIssuer
+	tokens atomic.Value
+
+	metrics *metrics
+	limiter *rateLimiter
+	// schemaVersion is the version a fully migrated database is at
+	schemaVersion int
+
+	// shuttingDown fails readiness checks once Drain or Shutdown has been
+	// called
+	shuttingDown int32
+}
+
+// defaultTimeout is the read and write timeout when ServerOptions leaves
+// them unset
+const defaultTimeout = 30 * time.Second
+
+// ServerOptions configures the HTTP listener
+type ServerOptions struct {
+	Host string
+	Port int
+	// ReadTimeout and WriteTimeout bound reading a request and writing its
+	// response, 30s each if zero. They also apply to the HTTP redirect
+	// listener.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// RateLimit is the requests a second each client IP may make, with
+	// bursts of up to RateBurst, see SetRateLimit
+	RateLimit float64
+	RateBurst int
 }
 
-// NewServer instantiates a new HTTP REST server
-func NewServer(host string, port int, db *db.Conn) *Server {
+// NewServer instantiates a new HTTP REST server backed by the given store
+func NewServer(opts ServerOptions, db db.Store, tokens *auth.TokenIssuer) *Server {
+	// Default timeouts are unlim, which is bad
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = defaultTimeout
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultTimeout
+	}
 	s := &Server{
 		srv: &http.Server{
-			Addr: fmt.Sprintf("%s:%d", host, port),
-			// Default timeouts are unlim, which is bad
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
+			Addr:         fmt.Sprintf("%s:%d", opts.Host, opts.Port),
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
 		},
-		db: db,
+		db:            db,
+		metrics:       newMetrics(db),
+		limiter:       newRateLimiter(opts.RateLimit, opts.RateBurst),
+		schemaVersion: migrate.Latest(),
 	}
+	s.tokens.Store(tokens)
 
 	// We could use the stdlib muxer, but gorilla is incredibly nice,
 	// lightweight, fulfills the standard interfaces, and comes with some
 	// nice additional features
 	r := mux.NewRouter()
+	r.Use(recordRoute, s.metrics.Instrument, s.rateLimit, s.authorizeService)
+	// Gorilla skips middleware when nothing matches, so the fallback
+	// handlers record and count their requests themselves
+	r.NotFoundHandler = recordRoute(s.metrics.Instrument(http.HandlerFunc(notFound)))
+	r.MethodNotAllowedHandler = recordRoute(s.metrics.Instrument(http.HandlerFunc(methodNotAllowed)))
+	s.router = r
+
 	r.HandleFunc("/ping", s.PingHandler)
+	r.HandleFunc("/healthz", s.Healthz).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", s.Readyz).Methods(http.MethodGet)
+	r.Handle("/metrics", s.metrics.Handler()).Methods(http.MethodGet)
+
+	r.HandleFunc("/register", s.Register).Methods(http.MethodPost)
+	r.HandleFunc("/login", s.Login).Methods(http.MethodPost)
+	r.HandleFunc("/token/refresh", s.RefreshToken).Methods(http.MethodPost)
+
+	// Everything below here requires a valid access token
+	authed := r.NewRoute().Subrouter()
+	authed.Use(s.Authenticate)
+
+	authed.HandleFunc(fmt.Sprintf("/note/{%s}", ParamNote), s.GetNote).Methods(http.MethodGet)
+	authed.HandleFunc(fmt.Sprintf("/note/{%s}", ParamNote), s.UpdateNote).Methods(http.MethodPut, http.MethodPatch)
+	authed.HandleFunc(fmt.Sprintf("/note/{%s}", ParamNote), s.DeleteNote).Methods(http.MethodDelete)
+	authed.HandleFunc(fmt.Sprintf("/note/{%s}/move", ParamNote), s.MoveNote).Methods(http.MethodPost)
+	authed.HandleFunc(fmt.Sprintf("/note/{%s}/revisions", ParamNote), s.GetRevisions).Methods(http.MethodGet)
+	authed.HandleFunc(fmt.Sprintf("/note/{%s}/diff", ParamNote), s.DiffRevisions).Methods(http.MethodGet)
+	authed.HandleFunc(fmt.Sprintf("/note/{%s}/revisions/{%s}/restore", ParamNote, ParamRevision), s.RestoreRevision).Methods(http.MethodPost)
 
-	r.HandleFunc(fmt.Sprintf("/note/{%s}", ParamNote), s.GetNote).Methods(http.MethodGet)
+	authed.HandleFunc("/notes", s.GetNoteList).Methods(http.MethodGet)
+	authed.HandleFunc("/notes", s.CreateNote).Methods(http.MethodPost)
+	authed.HandleFunc("/notes/order", s.ReorderNotes).Methods(http.MethodPut)
+	authed.HandleFunc("/notes/search", s.SearchNotes).Methods(http.MethodGet)
 
-	r.HandleFunc(fmt.Sprintf("/user/{%s}/notes", ParamUser), s.GetNoteList).Methods(http.MethodGet)
+	authed.HandleFunc("/tags", s.GetTags).Methods(http.MethodGet)
+	authed.HandleFunc("/tags", s.CreateTag).Methods(http.MethodPost)
+	authed.HandleFunc(fmt.Sprintf("/tag/{%s}", ParamTag), s.RenameTag).Methods(http.MethodPatch)
+	authed.HandleFunc(fmt.Sprintf("/tag/{%s}", ParamTag), s.DeleteTag).Methods(http.MethodDelete)
 
-	s.srv.Handler = r
+	authed.HandleFunc("/notebooks", s.GetNotebooks).Methods(http.MethodGet)
+	authed.HandleFunc("/notebooks", s.CreateNotebook).Methods(http.MethodPost)
+	authed.HandleFunc(fmt.Sprintf("/notebook/{%s}", ParamNotebook), s.GetNotebook).Methods(http.MethodGet)
+	authed.HandleFunc(fmt.Sprintf("/notebook/{%s}", ParamNotebook), s.RenameNotebook).Methods(http.MethodPatch)
+	authed.HandleFunc(fmt.Sprintf("/notebook/{%s}", ParamNotebook), s.DeleteNotebook).Methods(http.MethodDelete)
+
+	s.srv.Handler = s.AccessLog(r)
 
 	return s
 }
 
-// ListenAndServe begins listening on the designated port and serving requests
+// ListenAndServe begins listening on the designated port and serving requests.
+// It returns http.ErrServerClosed once Shutdown has been called.
 func (s *Server) ListenAndServe() error {
-	return s.srv.ListenAndServe()
+	if s.certs == nil {
+		return s.srv.ListenAndServe()
+	}
+
+	if s.redirect != nil {
+		go func() {
+			if err := s.redirect.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("error serving https redirects: %v", err)
+			}
+		}()
+	}
+	// The certificate comes from TLSConfig.GetCertificate
+	return s.srv.ListenAndServeTLS("", "")
+}
+
+// SetTokenIssuer replaces the token issuer, e.g. after the signing key is
+// rotated. Access tokens signed by the old issuer stop verifying at once,
+// and clients get new ones with their refresh tokens.
+func (s *Server) SetTokenIssuer(tokens *auth.TokenIssuer) {
+	s.tokens.Store(tokens)
+}
+
+// tokenIssuer returns the current token issuer
+func (s *Server) tokenIssuer() *auth.TokenIssuer {
+	return s.tokens.Load().(*auth.TokenIssuer)
+}
+
+// Drain fails readiness checks while the server keeps serving, so load
+// balancers stop sending traffic before Shutdown closes the listeners
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests
+// to finish, or for ctx to be done, whichever comes first
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	if s.redirect != nil {
+		if err := s.redirect.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return s.srv.Shutdown(ctx)
 }
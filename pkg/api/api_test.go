@@ -1,14 +1,845 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+	"github.com/voyagerstudio/haiku-auth/pkg/db/memory"
+	"github.com/voyagerstudio/haiku-auth/pkg/diff"
 )
 
-// TODO: Make this a real test
-// Just made this to get CI working
 func TestNewServer(t *testing.T) {
-	s := NewServer("", 0, nil)
+	s := NewServer(ServerOptions{}, nil, nil)
 	require.NotNil(t, s)
+	require.Equal(t, 30*time.Second, s.srv.ReadTimeout)
+	require.Equal(t, 30*time.Second, s.srv.WriteTimeout)
+
+	s = NewServer(ServerOptions{Host: "127.0.0.1", Port: 9090, ReadTimeout: 5 * time.Second, WriteTimeout: 10 * time.Second}, nil, nil)
+	require.Equal(t, "127.0.0.1:9090", s.srv.Addr)
+	require.Equal(t, 5*time.Second, s.srv.ReadTimeout)
+	require.Equal(t, 10*time.Second, s.srv.WriteTimeout)
+}
+
+// testServer starts a server backed by an in-memory store
+func testServer(t *testing.T) *httptest.Server {
+	tokens, err := auth.NewTokenIssuer(auth.AlgHS256, []byte("0123456789abcdef0123456789abcdef"), "haiku-auth", time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	s := NewServer(ServerOptions{}, memory.New(), tokens)
+	ts := httptest.NewServer(s.srv.Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do sends a request with an optional JSON body and bearer token, and decodes
+// a JSON response into out if it's non-nil
+func do(t *testing.T, ts *httptest.Server, method, path, token string, body, out interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&buf).Encode(body))
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, &buf)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+// login registers a user and returns their tokens
+func login(t *testing.T, ts *httptest.Server, username string) TokenResponse {
+	creds := Credentials{Username: username, Password: "correct horse"}
+	require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/register", "", creds, nil))
+
+	var tokens TokenResponse
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPost, "/login", "", creds, &tokens))
+	require.NotEmpty(t, tokens.AccessToken)
+	require.NotEmpty(t, tokens.RefreshToken)
+	return tokens
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	ts := testServer(t)
+	login(t, ts, "basho")
+
+	creds := Credentials{Username: "basho", Password: "correct horse"}
+	require.Equal(t, http.StatusConflict, do(t, ts, http.MethodPost, "/register", "", creds, nil))
+
+	creds.Password = "wrong horse"
+	require.Equal(t, http.StatusUnauthorized, do(t, ts, http.MethodPost, "/login", "", creds, nil))
+
+	creds.Username = "nobody"
+	require.Equal(t, http.StatusUnauthorized, do(t, ts, http.MethodPost, "/login", "", creds, nil))
+}
+
+func TestNotes(t *testing.T) {
+	ts := testServer(t)
+	basho := login(t, ts, "basho").AccessToken
+	buson := login(t, ts, "buson").AccessToken
+
+	require.Equal(t, http.StatusUnauthorized, do(t, ts, http.MethodGet, "/notes", "", nil, nil))
+	require.Equal(t, http.StatusUnauthorized, do(t, ts, http.MethodGet, "/notes", "garbage", nil, nil))
+
+	text := "an old silent pond"
+	var note db.Note
+	require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", basho, NoteRequest{Text: &text}, &note))
+	require.Equal(t, text, note.Text)
+
+	var list db.NoteList
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes", basho, nil, &list))
+	require.Equal(t, []string{note.ID}, list.Notes)
+
+	// Other users can neither see nor change the note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes", buson, nil, &list))
+	require.Empty(t, list.Notes)
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodGet, "/note/"+note.ID, buson, nil, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPatch, "/note/"+note.ID, buson, NoteRequest{Text: &text}, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodDelete, "/note/"+note.ID, buson, nil, nil))
+
+	text = "a frog jumps into the pond"
+	var updated db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPut, "/note/"+note.ID, basho, NoteRequest{Text: &text}, &updated))
+	require.Equal(t, text, updated.Text)
+	require.Equal(t, note.CreatedAt.Unix(), updated.CreatedAt.Unix())
+	require.False(t, updated.UpdatedAt.Before(note.UpdatedAt))
+
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodPut, "/note/"+note.ID, basho, NoteRequest{}, nil))
+
+	require.Equal(t, http.StatusNoContent, do(t, ts, http.MethodDelete, "/note/"+note.ID, basho, nil, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodGet, "/note/"+note.ID, basho, nil, nil))
+}
+
+func TestNoteListPages(t *testing.T) {
+	ts := testServer(t)
+	basho := login(t, ts, "basho").AccessToken
+
+	var created []string
+	for _, text := range []string{"furuike ya", "kawazu tobikomu", "mizu no oto"} {
+		var note db.Note
+		require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", basho, NoteRequest{Text: &text}, &note))
+		created = append(created, note.ID)
+	}
+
+	// Page through in sort order, two at a time
+	var page db.NoteList
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes?limit=2", basho, nil, &page))
+	require.Equal(t, created[:2], page.Notes)
+	require.Empty(t, page.Summaries)
+	require.NotEmpty(t, page.NextCursor)
+	var last db.NoteList
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes?limit=2&full=true&cursor="+page.NextCursor, basho, nil, &last))
+	require.Equal(t, created[2:], last.Notes)
+	require.Len(t, last.Summaries, 1)
+	require.Equal(t, "mizu no oto", last.Summaries[0].Text)
+	require.Empty(t, last.NextCursor)
+
+	var list db.NoteList
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes?sort=-order", basho, nil, &list))
+	require.Equal(t, []string{created[2], created[1], created[0]}, list.Notes)
+
+	// Only notes updated since the first edit
+	text := "an old silent pond"
+	var updated db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, "/note/"+created[1], basho, NoteRequest{Text: &text}, &updated))
+	since := url.QueryEscape(updated.UpdatedAt.Format(time.RFC3339Nano))
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes?sort=-updated_at&updated_since="+since, basho, nil, &list))
+	require.Equal(t, []string{created[1]}, list.Notes)
+
+	for _, query := range []string{"sort=text", "limit=0", "limit=201", "updated_since=yesterday", "full=maybe", "cursor=garbage"} {
+		require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodGet, "/notes?"+query, basho, nil, nil), query)
+	}
+	// A cursor only continues the sort it came from
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes?limit=1", basho, nil, &page))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodGet, "/notes?sort=created_at&cursor="+page.NextCursor, basho, nil, nil))
+}
+
+func TestReorderNotes(t *testing.T) {
+	ts := testServer(t)
+	basho := login(t, ts, "basho").AccessToken
+	buson := login(t, ts, "buson").AccessToken
+
+	var ids []string
+	for _, text := range []string{"furuike ya", "kawazu tobikomu", "mizu no oto"} {
+		var note db.Note
+		require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", basho, NoteRequest{Text: &text}, &note))
+		ids = append(ids, note.ID)
+	}
+	order := func() []string {
+		var list db.NoteList
+		require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes", basho, nil, &list))
+		return list.Notes
+	}
+
+	var moved db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPost, "/note/"+ids[2]+"/move", basho, MoveRequest{Before: ids[0]}, &moved))
+	require.Equal(t, ids[2], moved.ID)
+	require.Equal(t, []string{ids[2], ids[0], ids[1]}, order())
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPost, "/note/"+ids[2]+"/move", basho, MoveRequest{After: ids[1]}, nil))
+	require.Equal(t, ids, order())
+
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodPost, "/note/"+ids[0]+"/move", basho, MoveRequest{}, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, "/note/"+ids[0]+"/move", buson, MoveRequest{After: ids[1]}, nil))
+
+	reversed := []string{ids[2], ids[1], ids[0]}
+	require.Equal(t, http.StatusNoContent, do(t, ts, http.MethodPut, "/notes/order", basho, OrderRequest{Notes: reversed}, nil))
+	require.Equal(t, reversed, order())
+	// An order from a device that hasn't seen every note is rejected
+	require.Equal(t, http.StatusConflict, do(t, ts, http.MethodPut, "/notes/order", basho, OrderRequest{Notes: ids[:2]}, nil))
+	require.Equal(t, http.StatusConflict, do(t, ts, http.MethodPut, "/notes/order", buson, OrderRequest{Notes: ids}, nil))
+
+	// Orders stay unique
+	var first db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/note/"+ids[2], basho, nil, &first))
+	require.Equal(t, http.StatusConflict, do(t, ts, http.MethodPatch, "/note/"+ids[0], basho, NoteRequest{Order: &first.Order}, nil))
+
+	// New notes go last even when every order is negative
+	issa := login(t, ts, "issa").AccessToken
+	text, negative := "yase-gaeru", -5000
+	var note db.Note
+	require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", issa, NoteRequest{Text: &text}, &note))
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, "/note/"+note.ID, issa, NoteRequest{Order: &negative}, nil))
+	require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", issa, NoteRequest{Text: &text}, &note))
+	require.Equal(t, negative+db.NoteRankGap, note.Order)
+}
+
+func TestSearchNotes(t *testing.T) {
+	ts := testServer(t)
+	basho := login(t, ts, "basho").AccessToken
+	buson := login(t, ts, "buson").AccessToken
+
+	var ids []string
+	for _, text := range []string{"An old silent pond, a frog jumps in", "Frogs & <herons> by the pond", "The light of a candle"} {
+		var note db.Note
+		require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", basho, NoteRequest{Text: &text}, &note))
+		ids = append(ids, note.ID)
+	}
+
+	search := func(token, q string) []*db.SearchResult {
+		var res db.SearchResults
+		require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes/search?q="+url.QueryEscape(q), token, nil, &res))
+		return res.Results
+	}
+
+	res := search(basho, "frog pond")
+	require.Len(t, res, 2)
+	require.Equal(t, ids[1], res[0].Note.ID, "the shorter note ranks first")
+	require.Equal(t, "<mark>Frogs</mark> &amp; &lt;herons&gt; by the <mark>pond</mark>", res[0].Snippet)
+
+	res = search(basho, `"silent pond"`)
+	require.Len(t, res, 1)
+	require.Equal(t, ids[0], res[0].Note.ID)
+	require.Empty(t, search(basho, `"pond silent"`))
+
+	res = search(basho, "cand*")
+	require.Len(t, res, 1)
+	require.Equal(t, "The light of a <mark>candle</mark>", res[0].Snippet)
+
+	// Only the owner's notes are searched
+	require.Empty(t, search(buson, "pond"))
+
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodGet, "/notes/search?q=", basho, nil, nil))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodGet, "/notes/search?q=pond&limit=0", basho, nil, nil))
+}
+
+func TestTagsAndNotebooks(t *testing.T) {
+	ts := testServer(t)
+	basho := login(t, ts, "basho").AccessToken
+	buson := login(t, ts, "buson").AccessToken
+
+	var book db.Notebook
+	require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notebooks", basho, NotebookRequest{Name: " Spring "}, &book))
+	require.Equal(t, "Spring", book.Name)
+	require.Equal(t, http.StatusConflict, do(t, ts, http.MethodPost, "/notebooks", basho, NotebookRequest{Name: "Spring"}, nil))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodPost, "/notebooks", basho, NotebookRequest{Name: " "}, nil))
+
+	// New tags are created as notes use them
+	texts := []string{"furuike ya", "kawazu tobikomu", "mizu no oto"}
+	tags := [][]string{{"frog", "pond"}, {"frog"}, nil}
+	var ids []string
+	for i := range texts {
+		req := NoteRequest{Text: &texts[i], Tags: &tags[i]}
+		if i < 2 {
+			req.Notebook = &book.ID
+		}
+		var note db.Note
+		require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", basho, req, &note))
+		ids = append(ids, note.ID)
+	}
+	var note db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/note/"+ids[0], basho, nil, &note))
+	require.Equal(t, []string{"frog", "pond"}, note.Tags)
+	require.Equal(t, book.ID, note.Notebook)
+	// Another user's notebook can't be used
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, "/notes", buson, NoteRequest{Text: &texts[0], Notebook: &book.ID}, nil))
+
+	list := func(query string) []string {
+		var list db.NoteList
+		require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes?"+query, basho, nil, &list))
+		return list.Notes
+	}
+	require.Equal(t, ids[:2], list("tag=frog"))
+	require.Equal(t, ids[:1], list("tag=frog&tag=pond"))
+	require.Equal(t, ids[:2], list("notebook="+book.ID))
+	require.Empty(t, list("tag=toad"))
+
+	var tagList db.TagList
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/tags", basho, nil, &tagList))
+	require.Len(t, tagList.Tags, 2)
+	frog, pond := tagList.Tags[0], tagList.Tags[1]
+	require.Equal(t, "frog", frog.Name)
+	require.Equal(t, 2, frog.Notes)
+	require.Equal(t, 1, pond.Notes)
+
+	// Renames show on every note, deletes take the tag off them
+	var renamed db.Tag
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, "/tag/"+frog.ID, basho, TagRequest{Name: "kawazu"}, &renamed))
+	require.Equal(t, 2, renamed.Notes)
+	require.Equal(t, http.StatusConflict, do(t, ts, http.MethodPatch, "/tag/"+frog.ID, basho, TagRequest{Name: "pond"}, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodDelete, "/tag/"+pond.ID, buson, nil, nil))
+	require.Equal(t, http.StatusNoContent, do(t, ts, http.MethodDelete, "/tag/"+pond.ID, basho, nil, nil))
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/note/"+ids[0], basho, nil, &note))
+	require.Equal(t, []string{"kawazu"}, note.Tags)
+
+	// Taking a note out of its notebook and retagging it
+	empty, retag := "", []string{"water"}
+	var moved db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, "/note/"+ids[1], basho, NoteRequest{Notebook: &empty, Tags: &retag}, &moved))
+	require.Empty(t, moved.Notebook)
+	require.Equal(t, retag, moved.Tags)
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notebook/"+book.ID, basho, nil, &book))
+	require.Equal(t, 1, book.Notes)
+
+	// Deleting a notebook keeps its notes
+	require.Equal(t, http.StatusNoContent, do(t, ts, http.MethodDelete, "/notebook/"+book.ID, basho, nil, nil))
+	var kept db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/note/"+ids[0], basho, nil, &kept))
+	require.Empty(t, kept.Notebook)
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodGet, "/notebook/"+book.ID, basho, nil, nil))
+}
+
+func TestRevisions(t *testing.T) {
+	ts := testServer(t)
+	basho := login(t, ts, "basho").AccessToken
+	buson := login(t, ts, "buson").AccessToken
+
+	texts := []string{
+		"furuike ya\nkawazu tobikomu\nmizu no oto",
+		"furuike ya\nkawazu tobikomu\nmizu no oto\n",
+		"furuike ya\nkaeru tobikomu\nmizu no oto",
+	}
+	var note db.Note
+	require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes", basho, NoteRequest{Text: &texts[0]}, &note))
+	path := "/note/" + note.ID
+	for _, text := range texts[1:] {
+		require.Equal(t, http.StatusOK, do(t, ts, http.MethodPut, path, basho, NoteRequest{Text: &text}, nil))
+	}
+	// Changes that leave the text alone aren't revisions
+	tags := []string{"frog"}
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, path, basho, NoteRequest{Tags: &tags}, nil))
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPut, path, basho, NoteRequest{Text: &texts[2]}, nil))
+
+	var list db.RevisionList
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, path+"/revisions", basho, nil, &list))
+	require.Len(t, list.Revisions, 3)
+	require.Equal(t, 3, list.Revisions[0].Revision)
+	require.Equal(t, texts[2], list.Revisions[0].Text)
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodGet, path+"/revisions", buson, nil, nil))
+
+	var d DiffResponse
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, path+"/diff?from=1&to=3", basho, nil, &d))
+	require.Equal(t, []diff.Line{
+		{Op: diff.Equal, Text: "furuike ya", Old: 1, New: 1},
+		{Op: diff.Delete, Text: "kawazu tobikomu", Old: 2},
+		{Op: diff.Insert, Text: "kaeru tobikomu", New: 2},
+		{Op: diff.Equal, Text: "mizu no oto", Old: 3, New: 3},
+	}, d.Lines)
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodGet, path+"/diff?from=1&to=4", basho, nil, nil))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodGet, path+"/diff?from=1", basho, nil, nil))
+
+	var restored db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPost, path+"/revisions/1/restore", basho, nil, &restored))
+	require.Equal(t, texts[0], restored.Text)
+	require.Equal(t, []string{"frog"}, restored.Tags)
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, path+"/revisions", basho, nil, &list))
+	require.Len(t, list.Revisions, 4)
+	require.Equal(t, 1, list.Revisions[0].RestoredFrom)
+	require.Equal(t, texts[0], list.Revisions[0].Text)
+
+	// Restoring the current text again changes nothing
+	var again db.Note
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPost, path+"/revisions/1/restore", basho, nil, &again))
+	require.Equal(t, restored.UpdatedAt, again.UpdatedAt)
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, path+"/revisions", basho, nil, &list))
+	require.Len(t, list.Revisions, 4)
+
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, path+"/revisions/9/restore", basho, nil, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, path+"/revisions/1/restore", buson, nil, nil))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodPost, path+"/revisions/first/restore", basho, nil, nil))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodPost, path+"/revisions/2147483648/restore", basho, nil, nil))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodGet, path+"/diff?from=1&to=9999999999", basho, nil, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, path+"/revisions/2147483647/restore", basho, nil, nil))
+}
+
+func TestNoteHaiku(t *testing.T) {
+	ts := testServer(t)
+	basho := login(t, ts, "basho").AccessToken
+
+	text := "An old silent pond\nA frog jumps into the pond\nSplash! Silence again."
+	var note NoteResponse
+	require.Equal(t, http.StatusCreated, do(t, ts, http.MethodPost, "/notes?haiku=enforce", basho, NoteRequest{Text: &text}, &note))
+	require.Equal(t, text, note.Text)
+	require.True(t, note.Haiku.Conforms)
+	require.Equal(t, "5-7-5", note.Haiku.Pattern)
+
+	// Without the option there's no analysis
+	var plain NoteResponse
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, "/note/"+note.ID, basho, NoteRequest{Text: &text}, &plain))
+	require.Nil(t, plain.Haiku)
+
+	prose := "a frog jumped in the pond"
+	require.Equal(t, http.StatusUnprocessableEntity, do(t, ts, http.MethodPatch, "/note/"+note.ID+"?haiku=enforce", basho, NoteRequest{Text: &prose}, nil))
+	require.Equal(t, http.StatusUnprocessableEntity, do(t, ts, http.MethodPost, "/notes?haiku=enforce", basho, NoteRequest{Text: &prose}, nil))
+	require.Equal(t, http.StatusBadRequest, do(t, ts, http.MethodPost, "/notes?haiku=strict", basho, NoteRequest{Text: &prose}, nil))
+
+	var annotated NoteResponse
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, "/note/"+note.ID+"?haiku=annotate", basho, NoteRequest{Text: &prose}, &annotated))
+	require.False(t, annotated.Haiku.Conforms)
+	require.Equal(t, "6", annotated.Haiku.Pattern)
+
+	// Changing only the order leaves the text unchecked
+	order := 5
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPatch, "/note/"+note.ID+"?haiku=enforce", basho, NoteRequest{Order: &order}, &annotated))
+	require.False(t, annotated.Haiku.Conforms)
+}
+
+func TestRefreshToken(t *testing.T) {
+	ts := testServer(t)
+	first := login(t, ts, "basho")
+
+	var second TokenResponse
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodPost, "/token/refresh", "", RefreshRequest{first.RefreshToken}, &second))
+	require.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/notes", second.AccessToken, nil, nil))
+
+	// Replaying the first token revokes the whole family, including the
+	// second token that was never used
+	require.Equal(t, http.StatusUnauthorized, do(t, ts, http.MethodPost, "/token/refresh", "", RefreshRequest{first.RefreshToken}, nil))
+	require.Equal(t, http.StatusUnauthorized, do(t, ts, http.MethodPost, "/token/refresh", "", RefreshRequest{second.RefreshToken}, nil))
+}
+
+func TestHealth(t *testing.T) {
+	ts := testServer(t)
+
+	var health HealthResponse
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/healthz", "", nil, &health))
+	require.Equal(t, StatusOK, health.Status)
+
+	var ready HealthResponse
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/readyz", "", nil, &ready))
+	require.Equal(t, StatusOK, ready.Status)
+	require.Len(t, ready.Checks, 3)
+}
+
+func TestDrain(t *testing.T) {
+	tokens, err := auth.NewTokenIssuer(auth.AlgHS256, []byte("0123456789abcdef0123456789abcdef"), "haiku-auth", time.Minute, time.Hour)
+	require.NoError(t, err)
+	s := NewServer(ServerOptions{}, memory.New(), tokens)
+	ts := httptest.NewServer(s.srv.Handler)
+	defer ts.Close()
+
+	// While draining, readiness fails but requests are still served
+	s.Drain()
+	resp, err := ts.Client().Get(ts.URL + "/readyz")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	var ready HealthResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&ready))
+	require.Equal(t, StatusFail, ready.Status)
+	require.Equal(t, "shutdown", ready.Checks[0].Name)
+	require.Equal(t, StatusFail, ready.Checks[0].Status)
+	require.Equal(t, http.StatusOK, do(t, ts, http.MethodGet, "/healthz", "", nil, nil))
+	login(t, ts, "basho")
+}
+
+func TestMetrics(t *testing.T) {
+	ts := testServer(t)
+	require.Equal(t, http.StatusUnauthorized, do(t, ts, http.MethodGet, "/note/some-id", "", nil, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodGet, "/wp-admin/some-id", "", nil, nil))
+	require.Equal(t, http.StatusMethodNotAllowed, do(t, ts, http.MethodDelete, "/login", "", nil, nil))
+
+	resp, err := ts.Client().Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	// Requests are labelled with the route template, not the note ID
+	require.Contains(t, string(b), `haiku_http_requests_total{code="401",method="GET",route="/note/{note}"} 1`)
+	require.NotContains(t, string(b), "some-id")
+	// Including requests no route matches
+	require.Contains(t, string(b), `haiku_http_requests_total{code="404",method="GET",route="unmatched"} 1`)
+	require.Contains(t, string(b), `haiku_http_requests_total{code="405",method="DELETE",route="unmatched"} 1`)
+}
+
+func TestRequestID(t *testing.T) {
+	ts := testServer(t)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ping", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request-ID", "abc-123")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "abc-123", resp.Header.Get("X-Request-ID"))
+
+	// Invalid IDs are replaced rather than echoed
+	req.Header.Set("X-Request-ID", "has spaces")
+	resp, err = ts.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotEmpty(t, resp.Header.Get("X-Request-ID"))
+	require.NotEqual(t, "has spaces", resp.Header.Get("X-Request-ID"))
+}
+
+func TestStoreErrorStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := memory.New().GetNoteList(ctx, "user", db.NoteListOptions{})
+	require.Equal(t, http.StatusServiceUnavailable, storeErrorStatus(err))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = memory.New().GetNoteList(ctx, "user", db.NoteListOptions{})
+	require.Equal(t, http.StatusGatewayTimeout, storeErrorStatus(err))
+
+	require.Equal(t, http.StatusInternalServerError, storeErrorStatus(errors.New("boom")))
+	require.Equal(t, http.StatusServiceUnavailable, storeErrorStatus(fmt.Errorf("error pinging db: %w", db.ErrUnavailable)))
+	require.Equal(t, http.StatusNotFound, storeErrorStatus(fmt.Errorf("wrapped: %w", db.ErrNoteNotFound)))
+	require.Equal(t, http.StatusConflict, storeErrorStatus(db.ErrUserExists))
+	require.Equal(t, http.StatusForbidden, storeErrorStatus(&db.Error{Kind: db.KindForbidden}))
+	require.Equal(t, http.StatusBadRequest, storeErrorStatus(db.InvalidInput("user is empty")))
+}
+
+func TestErrorResponse(t *testing.T) {
+	ts := testServer(t)
+	token := login(t, ts, "basho").AccessToken
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/note/missing", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Request-ID", "abc-123")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	var problem Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	require.Equal(t, Problem{
+		Type:      "about:blank",
+		Title:     "Not Found",
+		Status:    http.StatusNotFound,
+		Detail:    "note not found",
+		RequestID: "abc-123",
+	}, problem)
+
+	// Requests no route matches get problem responses too
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		detail       string
+	}{
+		{http.MethodGet, "/nowhere", http.StatusNotFound, "no such endpoint"},
+		{http.MethodDelete, "/login", http.StatusMethodNotAllowed, "method not allowed"},
+	} {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Request-ID", "abc-123")
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, tc.status, resp.StatusCode)
+		require.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+		var problem Problem
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+		require.Equal(t, Problem{
+			Type:      "about:blank",
+			Title:     http.StatusText(tc.status),
+			Status:    tc.status,
+			Detail:    tc.detail,
+			RequestID: "abc-123",
+		}, problem)
+	}
+}
+
+func TestUnknownOwner(t *testing.T) {
+	ts := testServer(t)
+
+	// A valid token for a user the store doesn't have, e.g. one deleted
+	// since it was issued
+	tokens, err := auth.NewTokenIssuer(auth.AlgHS256, []byte("0123456789abcdef0123456789abcdef"), "haiku-auth", time.Minute, time.Hour)
+	require.NoError(t, err)
+	ghost, _, err := tokens.Issue("ghost")
+	require.NoError(t, err)
+
+	text := "furuike ya"
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, "/notes", ghost, NoteRequest{Text: &text}, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, "/tags", ghost, TagRequest{Name: "frog"}, nil))
+	require.Equal(t, http.StatusNotFound, do(t, ts, http.MethodPost, "/notebooks", ghost, NotebookRequest{Name: "spring"}, nil))
+}
+
+// writeCert writes a new self-signed certificate and key for localhost
+func writeCert(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile)
+
+	s := NewServer(ServerOptions{Port: 8443}, nil, nil)
+	require.NoError(t, s.EnableTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS12}))
+	first, err := s.srv.TLSConfig.GetCertificate(nil)
+	require.NoError(t, err)
+
+	// Rotate the certificate, and make sure it looks changed even on
+	// filesystems with coarse timestamps
+	writeCert(t, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	certs := s.srv.TLSConfig.GetCertificate
+	same, err := certs(nil)
+	require.NoError(t, err)
+	require.Equal(t, first, same, "certificate reloaded before the check interval")
+
+	// A broken certificate keeps the old one in place
+	s.certs.checkedAt = time.Time{}
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	kept, err := certs(nil)
+	require.NoError(t, err)
+	require.Equal(t, first, kept)
+
+	writeCert(t, certFile, keyFile)
+	require.NoError(t, os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute)))
+	s.certs.checkedAt = time.Time{}
+	second, err := certs(nil)
+	require.NoError(t, err)
+	require.NotEqual(t, first.Certificate, second.Certificate)
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewServer(ServerOptions{RateLimit: 1, RateBurst: 2}, memory.New(), nil)
+	ts := httptest.NewServer(s.srv.Handler)
+	defer ts.Close()
+
+	post := func() *http.Response {
+		resp, err := ts.Client().Post(ts.URL+"/login", "application/json", strings.NewReader("{}"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// The burst gets through, then the client has to wait
+	require.Equal(t, http.StatusUnauthorized, post().StatusCode)
+	require.Equal(t, http.StatusUnauthorized, post().StatusCode)
+	resp := post()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+	require.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	// Health checks are never limited
+	resp, err := ts.Client().Get(ts.URL + "/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Limits change in place
+	s.SetRateLimit(0, 0)
+	require.Equal(t, http.StatusUnauthorized, post().StatusCode)
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(2, 1)
+	l.now = func() time.Time { return now }
+
+	ok, _ := l.allow("a")
+	require.True(t, ok)
+	ok, wait := l.allow("a")
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = l.allow("b")
+	require.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.allow("a")
+	require.True(t, ok)
+
+	// Buckets that have refilled are dropped
+	now = now.Add(2 * rateSweepInterval)
+	ok, _ = l.allow("a")
+	require.True(t, ok)
+	require.Len(t, l.buckets, 1)
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	w := httptest.NewRecorder()
+	redirectHTTPS("8443").ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://example.com:8080/notes?x=1", nil))
+	require.Equal(t, http.StatusPermanentRedirect, w.Code)
+	require.Equal(t, "https://example.com:8443/notes?x=1", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	redirectHTTPS("443").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/ping", nil))
+	require.Equal(t, "https://example.com/ping", w.Header().Get("Location"))
+
+	// The redirect listener shares the configured timeouts
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile)
+	s := NewServer(ServerOptions{Port: 8443, ReadTimeout: 5 * time.Second, WriteTimeout: 10 * time.Second}, nil, nil)
+	require.NoError(t, s.EnableTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS12, RedirectAddr: ":8080"}))
+	require.Equal(t, 5*time.Second, s.redirect.ReadTimeout)
+	require.Equal(t, 10*time.Second, s.redirect.WriteTimeout)
+}
+
+// issueCert creates a certificate from tmpl signed by parent, or self-signed
+// if parent is nil
+func issueCert(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	issuer, signer := tmpl, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServicePolicy(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeCert(t, certFile, keyFile)
+
+	ca := issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600))
+	client := func(cn string) tls.Certificate {
+		return issueCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &ca)
+	}
+
+	policy := ServicePolicy{
+		Services: map[string][]string{"prober": {"cn:prober"}, "web": {"cn:web"}},
+		Routes:   map[string][]string{"/healthz": {"prober"}},
+	}
+	opts := TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, Policy: policy}
+
+	bad := opts
+	bad.Policy.Routes = map[string][]string{"/nope": {"prober"}}
+	require.Error(t, NewServer(ServerOptions{}, memory.New(), nil).EnableTLS(bad))
+	bad.Policy.Routes = map[string][]string{"/healthz": {"nobody"}}
+	require.Error(t, NewServer(ServerOptions{}, memory.New(), nil).EnableTLS(bad))
+	bad.Policy = ServicePolicy{Services: map[string][]string{"web": {"web"}}}
+	require.Error(t, NewServer(ServerOptions{}, memory.New(), nil).EnableTLS(bad))
+
+	s := NewServer(ServerOptions{}, memory.New(), nil)
+	require.NoError(t, s.EnableTLS(opts))
+	ts := httptest.NewUnstartedServer(s.srv.Handler)
+	ts.TLS = s.srv.TLSConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	get := func(path string, cert *tls.Certificate) int {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := c.Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	prober, web, stranger := client("prober"), client("web"), client("stranger")
+	require.Equal(t, http.StatusOK, get("/healthz", &prober))
+	require.Equal(t, http.StatusForbidden, get("/healthz", &web))
+	require.Equal(t, http.StatusForbidden, get("/healthz", &stranger))
+	require.Equal(t, http.StatusForbidden, get("/healthz", nil))
+	// Routes outside the policy are open to anyone
+	require.Equal(t, http.StatusOK, get("/ping", nil))
+	require.Equal(t, http.StatusOK, get("/ping", &web))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{web.Leaf, ca.Leaf}}}
+	service, ok := s.serviceIdentity(r)
+	require.True(t, ok)
+	require.Equal(t, "web", service)
 }
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+	"github.com/voyagerstudio/haiku-auth/pkg/requestid"
+)
+
+const (
+	// problemContentType is the media type of RFC 7807 error responses
+	problemContentType = "application/problem+json"
+	// retryAfterUnavailable is the Retry-After, in seconds, sent while the
+	// database can't be reached
+	retryAfterUnavailable = "1"
+)
+
+// Problem is an RFC 7807 problem details body, returned with every error
+// response
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// RequestID lets a client quote the request when reporting a problem
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError writes a problem response with the given status. detail is
+// shown to the client, so it mustn't leak anything internal.
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	b, err := json.Marshal(Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		RequestID: requestid.FromContext(r.Context()),
+	})
+	if err != nil {
+		reqLog(r).Errorf("error marshalling problem: %v", err)
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// notFound is the problem response for paths no route matches
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "no such endpoint")
+}
+
+// methodNotAllowed is the problem response for routes that don't accept the
+// request's method
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// writeStoreError writes the problem response for an error returned by the
+// store. Errors that are the client's fault carry their message as the
+// detail, anything else is logged with msg and reported without one.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	status := storeErrorStatus(err)
+
+	var storeErr *db.Error
+	if errors.As(err, &storeErr) && storeErr.Kind != db.KindInternal {
+		writeError(w, r, status, storeErr.Message)
+		return
+	}
+
+	reqLog(r).Errorf("%s: %v", msg, err)
+	if errors.Is(err, db.ErrUnavailable) {
+		// The pool reconnects on the next request, so ask clients to come
+		// back shortly rather than give up
+		w.Header().Set("Retry-After", retryAfterUnavailable)
+	}
+	writeError(w, r, status, "")
+}
+
+// storeErrorStatus picks the status code for a store error. A database
+// that's too slow to answer or can't be reached is reported as a timeout or
+// unavailable rather than a server error, since retrying later may well
+// succeed.
+func storeErrorStatus(err error) int {
+	switch db.KindOf(err) {
+	case db.KindNotFound:
+		return http.StatusNotFound
+	case db.KindConflict:
+		return http.StatusConflict
+	case db.KindForbidden:
+		return http.StatusForbidden
+	case db.KindInvalidInput:
+		return http.StatusBadRequest
+	}
+
+	switch {
+	case errors.Is(err, db.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, db.ErrCanceled), errors.Is(err, db.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
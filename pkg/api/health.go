@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readyCheckTimeout bounds each readiness check, so a hung database fails
+// the probe instead of hanging it
+const readyCheckTimeout = time.Second
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// HealthCheck is the result of a single health check
+type HealthCheck struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthResponse is the body of the health endpoints
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Healthz reports that the process is alive and serving requests. It
+// deliberately checks nothing else, so a database outage doesn't get every
+// pod restarted.
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, HealthResponse{Status: StatusOK, Checks: []HealthCheck{}})
+}
+
+// Readyz reports whether this instance should receive traffic: the database
+// is reachable, its schema is migrated, and the server isn't shutting down
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := []HealthCheck{
+		runCheck("shutdown", func() error {
+			if atomic.LoadInt32(&s.shuttingDown) == 1 {
+				return fmt.Errorf("server is shutting down")
+			}
+			return nil
+		}),
+		runCheck("database", func() error {
+			ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+			defer cancel()
+			return s.db.Ping(ctx)
+		}),
+		runCheck("migrations", func() error {
+			ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+			defer cancel()
+			version, err := s.db.SchemaVersion(ctx)
+			if err != nil {
+				return err
+			}
+			if version < s.schemaVersion {
+				return fmt.Errorf("schema is at version %d, expected %d", version, s.schemaVersion)
+			}
+			return nil
+		}),
+	}
+
+	resp := HealthResponse{Status: StatusOK, Checks: checks}
+	for _, c := range checks {
+		if c.Status != StatusOK {
+			resp.Status = StatusFail
+			reqLog(r).Warnf("readiness check %s failed: %s", c.Name, c.Error)
+		}
+	}
+
+	writeHealth(w, resp)
+}
+
+// runCheck times a check and records its outcome
+func runCheck(name string, check func() error) HealthCheck {
+	start := time.Now()
+	err := check()
+
+	c := HealthCheck{
+		Name:      name,
+		Status:    StatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		c.Status = StatusFail
+		c.Error = err.Error()
+	}
+	return c
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorf("error marshalling health response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
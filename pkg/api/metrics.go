@@ -0,0 +1,107 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "haiku"
+
+// metrics holds the HTTP instrumentation for a Server. Each Server has its
+// own registry so that several can exist in one process, as they do in tests.
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+// newMetrics creates and registers the HTTP metrics, along with Go runtime,
+// process and, if the store exposes its pool, sql.DB connection stats
+func newMetrics(store interface{}) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Total HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "HTTP request latency by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "HTTP requests currently being served by route.",
+		}, []string{"route"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.inFlight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	// Only the Postgres store has a connection pool to report on
+	if pool, ok := store.(interface{ DB() *sql.DB }); ok {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(pool.DB(), "postgres"))
+	}
+
+	return m
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Instrument records request counts, latencies and in-flight requests. It
+// must run as router middleware, after a route has been matched, so requests
+// are labelled with the route template rather than the raw path; labelling
+// by path would create a series for every note ID. Requests no route
+// matches are labelled unmatched.
+func (m *metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+
+		inFlight := m.inFlight.WithLabelValues(route)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		m.duration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// routeTemplate returns the path template of the matched route, e.g.
+// /note/{note}
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+	return tmpl
+}
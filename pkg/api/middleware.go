@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/voyagerstudio/haiku-auth/pkg/requestid"
+)
+
+type contextKey int
+
+const (
+	userIDKey contextKey = iota
+	requestInfoKey
+	serviceKey
+)
+
+// requestInfo collects details about a request from the handlers deeper in
+// the chain, so AccessLog can report them once the request completes
+type requestInfo struct {
+	route   string
+	userID  string
+	service string
+}
+
+// reqLog returns a log entry tagged with the request's ID
+func reqLog(r *http.Request) *log.Entry {
+	return requestid.Logger(r.Context())
+}
+
+// AccessLog assigns each request an ID, taken from the X-Request-ID header
+// when the client sends a valid one, and logs a structured entry for every
+// request once it completes. It wraps the whole router so that unmatched
+// requests are logged too.
+func (s *Server) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		w.Header().Set(requestid.Header, id)
+
+		info := &requestInfo{}
+		ctx := requestid.NewContext(r.Context(), id)
+		ctx = context.WithValue(ctx, requestInfoKey, info)
+
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		fields := log.Fields{
+			"request_id": id,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"route":      info.route,
+			"status":     rec.status,
+			"bytes":      rec.bytes,
+			"duration":   time.Since(start).Seconds(),
+			"remote":     r.RemoteAddr,
+		}
+		if info.userID != "" {
+			fields["user"] = info.userID
+		}
+		if info.service != "" {
+			fields["service"] = info.service
+		}
+		log.WithFields(fields).Info("request")
+	})
+}
+
+// recordRoute notes the matched route template for AccessLog. It runs as
+// router middleware since the route is only known once the router matches.
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+			info.route = routeTemplate(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UserIDFromContext returns the authenticated user ID stored by Authenticate
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(userIDKey).(string)
+	return id, ok && id != ""
+}
+
+// Authenticate validates the bearer token on a request and stores the
+// authenticated user ID in the request context
+func (s *Server) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || parts[1] == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="haiku-auth"`)
+			writeError(w, r, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		userID, err := s.tokenIssuer().Verify(parts[1])
+		if err != nil {
+			reqLog(r).Debugf("rejecting token: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="haiku-auth", error="invalid_token"`)
+			writeError(w, r, http.StatusUnauthorized, "invalid access token")
+			return
+		}
+
+		if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+			info.userID = userID
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// responseRecorder wraps a ResponseWriter to capture the status code and
+// number of bytes written, for metrics and logging
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	// Handlers that never call WriteHeader implicitly send a 200
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Prefixes of the certificate names in ServicePolicy.Services
+const (
+	certNameURI = "uri:"
+	certNameDNS = "dns:"
+	certNameCN  = "cn:"
+)
+
+// ServicePolicy maps client certificates to service identities, and limits
+// which services may call which routes
+type ServicePolicy struct {
+	// Services maps each service identity to the names that identify its
+	// certificates, each written as uri:<URI SAN>, dns:<DNS SAN> or
+	// cn:<subject common name>
+	Services map[string][]string
+	// Routes maps route templates, e.g. /notes, to the services allowed to
+	// call them. Routes that aren't listed are open to any caller.
+	Routes map[string][]string
+}
+
+// validCertName reports whether name is a certificate name ServicePolicy
+// understands
+func validCertName(name string) bool {
+	for _, prefix := range []string{certNameURI, certNameDNS, certNameCN} {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceFromContext returns the service identity stored by
+// authorizeService for a caller with a recognised client certificate
+func ServiceFromContext(ctx context.Context) (string, bool) {
+	service, ok := ctx.Value(serviceKey).(string)
+	return service, ok && service != ""
+}
+
+// enableClientCerts asks TLS clients for a certificate signed by the CA
+// bundle in caFile, and applies policy to the callers that present one.
+// Clients without a certificate can still call any route not in the policy.
+func (s *Server) enableClientCerts(caFile string, policy ServicePolicy) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("error reading client ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates in client ca %s", caFile)
+	}
+
+	services := make(map[string]string)
+	for service, names := range policy.Services {
+		for _, name := range names {
+			if !validCertName(name) {
+				return fmt.Errorf("invalid certificate name %q for service %s", name, service)
+			}
+			if other, ok := services[name]; ok && other != service {
+				return fmt.Errorf("certificate name %q belongs to both %s and %s", name, other, service)
+			}
+			services[name] = service
+		}
+	}
+
+	templates := make(map[string]bool)
+	err = s.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			templates[tmpl] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error listing routes: %v", err)
+	}
+
+	routes := make(map[string]map[string]bool)
+	for route, allowed := range policy.Routes {
+		if !templates[route] {
+			return fmt.Errorf("service policy for unknown route %s", route)
+		}
+		routes[route] = make(map[string]bool)
+		for _, service := range allowed {
+			if _, ok := policy.Services[service]; !ok {
+				return fmt.Errorf("route %s allows unknown service %s", route, service)
+			}
+			routes[route][service] = true
+		}
+	}
+
+	s.srv.TLSConfig.ClientCAs = pool
+	s.srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	s.services = services
+	s.serviceRoutes = routes
+	return nil
+}
+
+// serviceIdentity returns the service a request's verified client
+// certificate belongs to, if any
+func (s *Server) serviceIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+
+	// SANs first, they're what modern certificates are issued for
+	var names []string
+	for _, uri := range leaf.URIs {
+		names = append(names, certNameURI+uri.String())
+	}
+	for _, dns := range leaf.DNSNames {
+		names = append(names, certNameDNS+dns)
+	}
+	if leaf.Subject.CommonName != "" {
+		names = append(names, certNameCN+leaf.Subject.CommonName)
+	}
+
+	for _, name := range names {
+		if service, ok := s.services[name]; ok {
+			return service, true
+		}
+	}
+	return "", false
+}
+
+// authorizeService stores the caller's service identity in the request
+// context and enforces the per-route service policy. It runs as router
+// middleware since the policy is keyed by route template.
+func (s *Server) authorizeService(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service, ok := s.serviceIdentity(r)
+		if ok {
+			if info, infoOK := r.Context().Value(requestInfoKey).(*requestInfo); infoOK {
+				info.service = service
+			}
+			r = r.WithContext(context.WithValue(r.Context(), serviceKey, service))
+		}
+
+		if allowed, limited := s.serviceRoutes[routeTemplate(r)]; limited {
+			if !ok {
+				writeError(w, r, http.StatusForbidden, "a recognised client certificate is required")
+				return
+			}
+			if !allowed[service] {
+				reqLog(r).Warnf("service %s denied %s", service, routeTemplate(r))
+				writeError(w, r, http.StatusForbidden, fmt.Sprintf("service %s may not call this route", service))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// NotebookRequest is the request body for creating and renaming notebooks
+type NotebookRequest struct {
+	Name string `json:"name"`
+}
+
+// GetNotebooks returns the authenticated user's notebooks, with how many
+// notes are in each
+func (s *Server) GetNotebooks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in getnotebooks")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	notebooks, err := s.db.GetNotebooks(r.Context(), userID)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error getting notebooks for user %s", userID))
+		return
+	}
+
+	b, err := json.Marshal(notebooks)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling notebooks for user %s: %v", userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// GetNotebook returns a notebook owned by the authenticated user
+func (s *Server) GetNotebook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in getnotebook")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	notebookID := mux.Vars(r)[ParamNotebook]
+	if notebookID == "" {
+		reqLog(r).Error("empty notebook in getnotebook")
+		writeError(w, r, http.StatusBadRequest, "notebook ID is empty")
+		return
+	}
+
+	notebook, err := s.db.GetNotebook(r.Context(), userID, notebookID)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error getting notebook %s for user %s", notebookID, userID))
+		return
+	}
+
+	b, err := json.Marshal(notebook)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling notebook %s for user %s: %v", notebookID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// CreateNotebook creates a notebook for the authenticated user
+func (s *Server) CreateNotebook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in createnotebook")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	var req NotebookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding createnotebook request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	notebook, err := s.db.CreateNotebook(r.Context(), userID, req.Name)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error creating notebook for user %s", userID))
+		return
+	}
+
+	b, err := json.Marshal(notebook)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling notebook %s for user %s: %v", notebook.ID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/notebook/%s", notebook.ID))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// RenameNotebook renames a notebook owned by the authenticated user
+func (s *Server) RenameNotebook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in renamenotebook")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	notebookID := mux.Vars(r)[ParamNotebook]
+	if notebookID == "" {
+		reqLog(r).Error("empty notebook in renamenotebook")
+		writeError(w, r, http.StatusBadRequest, "notebook ID is empty")
+		return
+	}
+
+	var req NotebookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding renamenotebook request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	notebook, err := s.db.RenameNotebook(r.Context(), userID, notebookID, req.Name)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error renaming notebook %s for user %s", notebookID, userID))
+		return
+	}
+
+	b, err := json.Marshal(notebook)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling notebook %s for user %s: %v", notebookID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// DeleteNotebook deletes a notebook owned by the authenticated user. Its
+// notes are kept, outside any notebook.
+func (s *Server) DeleteNotebook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in deletenotebook")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	notebookID := mux.Vars(r)[ParamNotebook]
+	if notebookID == "" {
+		reqLog(r).Error("empty notebook in deletenotebook")
+		writeError(w, r, http.StatusBadRequest, "notebook ID is empty")
+		return
+	}
+
+	if err := s.db.DeleteNotebook(r.Context(), userID, notebookID); err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error deleting notebook %s for user %s", notebookID, userID))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,68 +2,434 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+	"github.com/voyagerstudio/haiku-auth/pkg/haiku"
 )
 
-// GetNoteList returns a list of note IDs for a given user ID
+// maxNoteLen is the maximum number of characters in a note
+const maxNoteLen = 10000
+
+// Values of the haiku query parameter on note create and update
+const (
+	// haikuAnnotate adds the haiku analysis to the response
+	haikuAnnotate = "annotate"
+	// haikuEnforce also rejects text that isn't a 5-7-5 haiku
+	haikuEnforce = "enforce"
+)
+
+// NoteRequest is the request body for creating and updating notes
+type NoteRequest struct {
+	Text  *string `json:"text"`
+	Order *int    `json:"order"`
+	// Notebook is a notebook ID, empty takes the note out of its notebook
+	Notebook *string `json:"notebook"`
+	// Tags are tag names, replacing the note's tags
+	Tags *[]string `json:"tags"`
+}
+
+// MoveRequest is the request body for moving a note directly before or
+// after another. Exactly one of the two is set.
+type MoveRequest struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// OrderRequest is the request body for putting every note in order
+type OrderRequest struct {
+	Notes []string `json:"notes"`
+}
+
+// NoteResponse is a note as returned by create and update, with the haiku
+// analysis of its text if it was asked for
+type NoteResponse struct {
+	*db.Note
+	Haiku *haiku.Analysis `json:"haiku,omitempty"`
+}
+
+// GetNoteList returns a page of note IDs for the authenticated user, see
+// noteListOptions for the query parameters
 func (s *Server) GetNoteList(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	user := params[ParamUser]
-	if user == "" {
-		log.Error("empty user in getnotelist")
-		w.WriteHeader(http.StatusBadRequest)
+	user, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in getnotelist")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	opts, err := noteListOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	notes, err := s.db.GetNoteList(user)
+	notes, err := s.db.GetNoteList(r.Context(), user, opts)
 	if err != nil {
-		log.Errorf("error getting note list for user %s: %v", user, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, r, err, fmt.Sprintf("error getting note list for user %s", user))
 		return
 	}
 
 	b, err := json.Marshal(notes)
 	if err != nil {
-		log.Errorf("error marshalling note list for user %s: %v", user, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		reqLog(r).Errorf("error marshalling note list for user %s: %v", user, err)
+		writeError(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
 	w.Write(b)
 }
 
-// GetNote returns all note information for a given note ID
+// GetNote returns all note information for a given note ID owned by the
+// authenticated user
 func (s *Server) GetNote(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	userID := params[ParamUser]
-	if userID == "" {
-		log.Error("empty user in getnotelist")
-		w.WriteHeader(http.StatusBadRequest)
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in getnote")
+		writeError(w, r, http.StatusUnauthorized, "")
 		return
 	}
-	noteID := params[ParamNote]
+	noteID := mux.Vars(r)[ParamNote]
 	if noteID == "" {
-		log.Error("empty note in getnotelist")
-		w.WriteHeader(http.StatusBadRequest)
+		reqLog(r).Error("empty note in getnote")
+		writeError(w, r, http.StatusBadRequest, "note ID is empty")
 		return
 	}
 
-	note, err := s.db.GetNote(userID, noteID)
+	note, err := s.db.GetNote(r.Context(), userID, noteID)
 	if err != nil {
-		log.Errorf("error getting note %s for user %s: %v", noteID, userID, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, r, err, fmt.Sprintf("error getting note %s for user %s", noteID, userID))
 		return
 	}
 
 	b, err := json.Marshal(note)
 	if err != nil {
-		log.Errorf("error marshalling note %s for user %s: %v", noteID, userID, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		reqLog(r).Errorf("error marshalling note %s for user %s: %v", noteID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Write(b)
+}
+
+// CreateNote creates a new note for the authenticated user
+func (s *Server) CreateNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in createnote")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	var req NoteRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding createnote request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+	if req.Text == nil || !validNoteText(*req.Text) {
+		reqLog(r).Error("invalid text in createnote")
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("text must be between 1 and %d characters of valid UTF-8", maxNoteLen))
+		return
+	}
+	mode := r.URL.Query().Get("haiku")
+	if !checkHaiku(w, r, mode, req.Text) {
+		return
+	}
+
+	create := db.NewNote{Text: *req.Text}
+	if req.Notebook != nil {
+		create.Notebook = *req.Notebook
+	}
+	if req.Tags != nil {
+		create.Tags = *req.Tags
+	}
+	note, err := s.db.CreateNote(r.Context(), userID, create)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error creating note for user %s", userID))
+		return
+	}
+
+	b, err := json.Marshal(noteResponse(note, mode))
+	if err != nil {
+		reqLog(r).Errorf("error marshalling note %s for user %s: %v", note.ID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/note/%s", note.ID))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// UpdateNote modifies a note owned by the authenticated user. PUT requires
+// the note text, PATCH only changes the fields present in the request.
+func (s *Server) UpdateNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in updatenote")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	noteID := mux.Vars(r)[ParamNote]
+	if noteID == "" {
+		reqLog(r).Error("empty note in updatenote")
+		writeError(w, r, http.StatusBadRequest, "note ID is empty")
+		return
+	}
+
+	var req NoteRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding updatenote request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+	if r.Method == http.MethodPut && req.Text == nil {
+		reqLog(r).Error("missing text in updatenote")
+		writeError(w, r, http.StatusBadRequest, "text is required")
+		return
+	}
+	if req.Text != nil && !validNoteText(*req.Text) {
+		reqLog(r).Error("invalid text in updatenote")
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("text must be between 1 and %d characters of valid UTF-8", maxNoteLen))
+		return
+	}
+	mode := r.URL.Query().Get("haiku")
+	if !checkHaiku(w, r, mode, req.Text) {
+		return
+	}
+
+	note, err := s.db.UpdateNote(r.Context(), userID, noteID, db.NoteUpdate{
+		Text:     req.Text,
+		Order:    req.Order,
+		Notebook: req.Notebook,
+		Tags:     req.Tags,
+	})
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error updating note %s for user %s", noteID, userID))
+		return
+	}
+
+	b, err := json.Marshal(noteResponse(note, mode))
+	if err != nil {
+		reqLog(r).Errorf("error marshalling note %s for user %s: %v", noteID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 }
+
+// DeleteNote deletes a note owned by the authenticated user
+func (s *Server) DeleteNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in deletenote")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	noteID := mux.Vars(r)[ParamNote]
+	if noteID == "" {
+		reqLog(r).Error("empty note in deletenote")
+		writeError(w, r, http.StatusBadRequest, "note ID is empty")
+		return
+	}
+
+	err := s.db.DeleteNote(r.Context(), userID, noteID)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error deleting note %s for user %s", noteID, userID))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MoveNote moves a note owned by the authenticated user before or after
+// another of their notes
+func (s *Server) MoveNote(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in movenote")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	noteID := mux.Vars(r)[ParamNote]
+	if noteID == "" {
+		reqLog(r).Error("empty note in movenote")
+		writeError(w, r, http.StatusBadRequest, "note ID is empty")
+		return
+	}
+
+	var req MoveRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding movenote request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	note, err := s.db.MoveNote(r.Context(), userID, noteID, db.NoteMove{Before: req.Before, After: req.After})
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error moving note %s for user %s", noteID, userID))
+		return
+	}
+
+	b, err := json.Marshal(note)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling note %s for user %s: %v", noteID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// ReorderNotes puts all of the authenticated user's notes in the given
+// order
+func (s *Server) ReorderNotes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in reordernotes")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	var req OrderRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding reordernotes request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	if err := s.db.ReorderNotes(r.Context(), userID, req.Notes); err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error reordering notes for user %s", userID))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SearchNotes returns the authenticated user's notes matching the q query
+// parameter, best match first, up to limit of them
+func (s *Server) SearchNotes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in searchnotes")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", db.MaxSearchLimit))
+			return
+		}
+		limit = n
+	}
+
+	results, err := s.db.SearchNotes(r.Context(), userID, q.Get("q"), limit)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error searching notes for user %s", userID))
+		return
+	}
+
+	b, err := json.Marshal(results)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling search results for user %s: %v", userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// checkHaiku validates the haiku query parameter, and with enforce, that the
+// new text is a 5-7-5 haiku. It writes the error response and returns false
+// if either fails. A PATCH that leaves the text alone isn't checked.
+func checkHaiku(w http.ResponseWriter, r *http.Request, mode string, text *string) bool {
+	switch mode {
+	case "", haikuAnnotate:
+		return true
+	case haikuEnforce:
+	default:
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("haiku must be %s or %s", haikuAnnotate, haikuEnforce))
+		return false
+	}
+
+	if text == nil {
+		return true
+	}
+	if a := haiku.Analyze(*text); !a.Conforms {
+		writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("text is not a 5-7-5 haiku, its lines have %s syllables", a.Pattern))
+		return false
+	}
+	return true
+}
+
+// noteResponse adds the haiku analysis to a note if mode asks for it
+func noteResponse(note *db.Note, mode string) NoteResponse {
+	resp := NoteResponse{Note: note}
+	if mode != "" {
+		resp.Haiku = haiku.Analyze(note.Text)
+	}
+	return resp
+}
+
+// noteListOptions reads the note list query parameters: sort (order,
+// created_at or updated_at, prefixed with - for descending), limit, cursor,
+// updated_since (RFC 3339), full, tag (repeatable) and notebook. The store
+// checks the values.
+func noteListOptions(q url.Values) (db.NoteListOptions, error) {
+	opts := db.NoteListOptions{
+		Cursor:   q.Get("cursor"),
+		Tags:     q["tag"],
+		Notebook: q.Get("notebook"),
+	}
+
+	sort := q.Get("sort")
+	if strings.HasPrefix(sort, "-") {
+		opts.Desc = true
+		sort = sort[1:]
+	}
+	opts.Sort = db.NoteSort(sort)
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("limit must be between 1 and %d", db.MaxNoteListLimit)
+		}
+		opts.Limit = n
+	}
+	if since := q.Get("updated_since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return opts, fmt.Errorf("updated_since must be an RFC 3339 time")
+		}
+		opts.UpdatedSince = t
+	}
+	if full := q.Get("full"); full != "" {
+		b, err := strconv.ParseBool(full)
+		if err != nil {
+			return opts, fmt.Errorf("full must be true or false")
+		}
+		opts.Full = b
+	}
+	return opts, nil
+}
+
+// validNoteText reports whether text is acceptable as the body of a note
+func validNoteText(text string) bool {
+	return text != "" && utf8.ValidString(text) && utf8.RuneCountInString(text) <= maxNoteLen
+}
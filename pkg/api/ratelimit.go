@@ -0,0 +1,132 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateSweepInterval is how often idle buckets are dropped
+const rateSweepInterval = time.Minute
+
+// unlimitedRoutes are never rate limited, so probes and scrapes keep working
+// while clients are being throttled
+var unlimitedRoutes = map[string]bool{
+	"/ping":    true,
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// rateLimiter is a token bucket per client. Each bucket holds up to burst
+// tokens and refills at rate tokens a second, and every request takes one.
+// The limits can change while it's in use.
+type rateLimiter struct {
+	mu sync.Mutex
+	// rate is in tokens a second, 0 means unlimited
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	sweptAt time.Time
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{buckets: make(map[string]*bucket), now: time.Now}
+	l.setLimits(rate, burst)
+	return l
+}
+
+// setLimits changes the limits from now on. Clients keep the tokens they
+// have, up to the new burst.
+func (l *rateLimiter) setLimits(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	l.rate = rate
+	l.burst = float64(burst)
+}
+
+// allow takes a token from key's bucket. If there's none left it returns
+// false, with how long until there is.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have had time to refill, since a new bucket
+// starts out full anyway
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < rateSweepInterval {
+		return
+	}
+	l.sweptAt = now
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.at) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// SetRateLimit changes the per-client rate limit, in requests a second with
+// bursts of up to burst requests. A rate of 0 turns limiting off.
+func (s *Server) SetRateLimit(rate float64, burst int) {
+	s.limiter.setLimits(rate, burst)
+}
+
+// rateLimit rejects requests from clients over the rate limit with 429 Too
+// Many Requests. Clients are told apart by IP address.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedRoutes[routeTemplate(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := s.limiter.allow(clientIP(r))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/voyagerstudio/haiku-auth/pkg/diff"
+)
+
+// DiffResponse is the line by line difference between two revisions of a
+// note
+type DiffResponse struct {
+	From  int         `json:"from"`
+	To    int         `json:"to"`
+	Lines []diff.Line `json:"lines"`
+}
+
+// GetRevisions returns every revision of a note owned by the authenticated
+// user, newest first
+func (s *Server) GetRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in getrevisions")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	noteID := mux.Vars(r)[ParamNote]
+	if noteID == "" {
+		reqLog(r).Error("empty note in getrevisions")
+		writeError(w, r, http.StatusBadRequest, "note ID is empty")
+		return
+	}
+
+	revisions, err := s.db.GetRevisions(r.Context(), userID, noteID)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error getting revisions of note %s for user %s", noteID, userID))
+		return
+	}
+
+	b, err := json.Marshal(revisions)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling revisions of note %s for user %s: %v", noteID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// DiffRevisions compares two revisions of a note owned by the authenticated
+// user, given by the from and to query parameters
+func (s *Server) DiffRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in diffrevisions")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	noteID := mux.Vars(r)[ParamNote]
+	if noteID == "" {
+		reqLog(r).Error("empty note in diffrevisions")
+		writeError(w, r, http.StatusBadRequest, "note ID is empty")
+		return
+	}
+	q := r.URL.Query()
+	from, err := revisionNumber("from", q.Get("from"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := revisionNumber("to", q.Get("to"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	older, err := s.db.GetRevision(r.Context(), userID, noteID, from)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error getting revision %d of note %s for user %s", from, noteID, userID))
+		return
+	}
+	newer, err := s.db.GetRevision(r.Context(), userID, noteID, to)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error getting revision %d of note %s for user %s", to, noteID, userID))
+		return
+	}
+
+	b, err := json.Marshal(DiffResponse{From: from, To: to, Lines: diff.Lines(older.Text, newer.Text)})
+	if err != nil {
+		reqLog(r).Errorf("error marshalling diff of note %s for user %s: %v", noteID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// RestoreRevision makes an older revision of a note owned by the
+// authenticated user its current text, as a new revision
+func (s *Server) RestoreRevision(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in restorerevision")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	noteID := mux.Vars(r)[ParamNote]
+	if noteID == "" {
+		reqLog(r).Error("empty note in restorerevision")
+		writeError(w, r, http.StatusBadRequest, "note ID is empty")
+		return
+	}
+	revision, err := revisionNumber("revision", mux.Vars(r)[ParamRevision])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	note, err := s.db.RestoreRevision(r.Context(), userID, noteID, revision)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error restoring revision %d of note %s for user %s", revision, noteID, userID))
+		return
+	}
+
+	b, err := json.Marshal(note)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling note %s for user %s: %v", noteID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// revisionNumber parses a revision number from the request. Revisions are
+// numbered with postgres integers, so anything past MaxInt32 is rejected
+// rather than failing the query.
+func revisionNumber(name, value string) (int, error) {
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a revision number", name)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// TagRequest is the request body for creating and renaming tags
+type TagRequest struct {
+	Name string `json:"name"`
+}
+
+// GetTags returns the authenticated user's tags, with how many notes carry
+// each
+func (s *Server) GetTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in gettags")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	tags, err := s.db.GetTags(r.Context(), userID)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error getting tags for user %s", userID))
+		return
+	}
+
+	b, err := json.Marshal(tags)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling tags for user %s: %v", userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// CreateTag creates a tag for the authenticated user
+func (s *Server) CreateTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in createtag")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	var req TagRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding createtag request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	tag, err := s.db.CreateTag(r.Context(), userID, req.Name)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error creating tag for user %s", userID))
+		return
+	}
+
+	b, err := json.Marshal(tag)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling tag %s for user %s: %v", tag.ID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// RenameTag renames a tag owned by the authenticated user
+func (s *Server) RenameTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in renametag")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	tagID := mux.Vars(r)[ParamTag]
+	if tagID == "" {
+		reqLog(r).Error("empty tag in renametag")
+		writeError(w, r, http.StatusBadRequest, "tag ID is empty")
+		return
+	}
+
+	var req TagRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding renametag request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	tag, err := s.db.RenameTag(r.Context(), userID, tagID, req.Name)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error renaming tag %s for user %s", tagID, userID))
+		return
+	}
+
+	b, err := json.Marshal(tag)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling tag %s for user %s: %v", tagID, userID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// DeleteTag deletes a tag owned by the authenticated user, taking it off
+// every note
+func (s *Server) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := UserIDFromContext(r.Context())
+	if !ok {
+		reqLog(r).Error("no authenticated user in deletetag")
+		writeError(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	tagID := mux.Vars(r)[ParamTag]
+	if tagID == "" {
+		reqLog(r).Error("empty tag in deletetag")
+		writeError(w, r, http.StatusBadRequest, "tag ID is empty")
+		return
+	}
+
+	if err := s.db.DeleteTag(r.Context(), userID, tagID); err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error deleting tag %s for user %s", tagID, userID))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
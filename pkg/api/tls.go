@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certCheckInterval is how often handshakes check the certificate files for
+// changes. Rotated certificates are picked up within this long.
+const certCheckInterval = 10 * time.Second
+
+// TLSOptions configures HTTPS
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is the lowest TLS version accepted, e.g. tls.VersionTLS12
+	MinVersion uint16
+	// CipherSuites limits the TLS 1.2 cipher suites, Go's defaults are used
+	// if it's empty. TLS 1.3 suites aren't configurable.
+	CipherSuites []uint16
+	// RedirectAddr, if set, is the address of a plain HTTP listener that
+	// redirects every request to HTTPS
+	RedirectAddr string
+
+	// ClientCAFile, if set, is a PEM bundle of CAs for client certificates.
+	// Clients may then authenticate with one, and Policy decides which
+	// service they are and which routes they may call.
+	ClientCAFile string
+	Policy       ServicePolicy
+}
+
+// EnableTLS makes the server serve HTTPS. The certificate is loaded now, so
+// a bad one fails at startup, and reloaded whenever its files change.
+func (s *Server) EnableTLS(opts TLSOptions) error {
+	certs := &certReloader{certFile: opts.CertFile, keyFile: opts.KeyFile}
+	if err := certs.load(); err != nil {
+		return err
+	}
+
+	s.srv.TLSConfig = &tls.Config{
+		MinVersion:     opts.MinVersion,
+		CipherSuites:   opts.CipherSuites,
+		GetCertificate: certs.getCertificate,
+	}
+	s.certs = certs
+
+	if opts.ClientCAFile != "" {
+		if err := s.enableClientCerts(opts.ClientCAFile, opts.Policy); err != nil {
+			return err
+		}
+	}
+
+	if opts.RedirectAddr != "" {
+		_, port, err := net.SplitHostPort(s.srv.Addr)
+		if err != nil {
+			return fmt.Errorf("error parsing api address %s: %v", s.srv.Addr, err)
+		}
+		s.redirect = &http.Server{
+			Addr:         opts.RedirectAddr,
+			Handler:      redirectHTTPS(port),
+			ReadTimeout:  s.srv.ReadTimeout,
+			WriteTimeout: s.srv.WriteTimeout,
+		}
+	}
+	return nil
+}
+
+// redirectHTTPS redirects every request to the same host and path over
+// HTTPS on the given port
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		// 308 rather than 301 so clients repeat POSTs with their body
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// certReloader serves a certificate loaded from disk, and reloads it when
+// the files change. Handshakes in progress keep the certificate they started
+// with, so rotation never drops a connection.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checkedAt) >= certCheckInterval {
+		c.checkedAt = time.Now()
+		if modTime, err := c.latestModTime(); err != nil {
+			log.Errorf("error checking tls certificate, keeping the old one: %v", err)
+		} else if !modTime.Equal(c.modTime) {
+			if err := c.loadLocked(); err != nil {
+				log.Errorf("error reloading tls certificate, keeping the old one: %v", err)
+			} else {
+				log.Info("reloaded tls certificate")
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// load reads the certificate and key
+func (c *certReloader) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkedAt = time.Now()
+	return c.loadLocked()
+}
+
+func (c *certReloader) loadLocked() error {
+	// Take the time first, so a change during the read is seen next check
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading tls certificate: %v", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// latestModTime returns when the certificate or key last changed. Stat
+// follows symlinks, so Kubernetes swapping a mounted secret counts.
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
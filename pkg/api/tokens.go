@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+)
+
+// TokenResponse is returned on a successful login or token refresh
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshRequest is the request body for a token refresh
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. The presented refresh token can't be used again.
+func (s *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		reqLog(r).Errorf("error decoding refresh request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	refresh, err := auth.NewRefreshToken()
+	if err != nil {
+		reqLog(r).Errorf("error generating refresh token: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	user, err := s.db.RotateRefreshToken(r.Context(), req.RefreshToken, refresh, time.Now().Add(s.tokenIssuer().RefreshTTL()))
+	if errors.Is(err, db.ErrRefreshTokenReused) {
+		reqLog(r).Warn("refresh token reuse detected, revoked token family")
+		writeError(w, r, http.StatusUnauthorized, "invalid refresh token")
+		return
+	}
+	if errors.Is(err, db.ErrInvalidRefreshToken) {
+		writeError(w, r, http.StatusUnauthorized, "invalid refresh token")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err, "error rotating refresh token")
+		return
+	}
+
+	s.writeTokens(w, r, user, refresh)
+}
+
+// writeTokens issues an access token for the user and writes it along with
+// the given refresh token as a TokenResponse
+func (s *Server) writeTokens(w http.ResponseWriter, r *http.Request, user, refresh string) {
+	tokens := s.tokenIssuer()
+	token, _, err := tokens.Issue(user)
+	if err != nil {
+		reqLog(r).Errorf("error issuing token for user %s: %v", user, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	b, err := json.Marshal(TokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(tokens.TTL().Seconds()),
+		RefreshToken: refresh,
+	})
+	if err != nil {
+		reqLog(r).Errorf("error marshalling token for user %s: %v", user, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+)
+
+const (
+	minUsernameLen = 3
+	maxUsernameLen = 64
+	minPasswordLen = 8
+	// argon2 has no input limit, but there's no reason to hash a novel
+	maxPasswordLen = 256
+
+	// maxBodyBytes caps the size of JSON request bodies
+	maxBodyBytes = 1 << 20
+)
+
+// Credentials is the request body for registration and login
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Register creates a new user from a username and password
+func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
+	var creds Credentials
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&creds); err != nil {
+		reqLog(r).Errorf("error decoding register request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	if len(creds.Username) < minUsernameLen || len(creds.Username) > maxUsernameLen {
+		reqLog(r).Error("invalid username length in register")
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("username must be between %d and %d bytes", minUsernameLen, maxUsernameLen))
+		return
+	}
+	if len(creds.Password) < minPasswordLen || len(creds.Password) > maxPasswordLen {
+		reqLog(r).Error("invalid password length in register")
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("password must be between %d and %d bytes", minPasswordLen, maxPasswordLen))
+		return
+	}
+
+	user, err := s.db.CreateUser(r.Context(), creds.Username, creds.Password)
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error creating user %s", creds.Username))
+		return
+	}
+
+	b, err := json.Marshal(user)
+	if err != nil {
+		reqLog(r).Errorf("error marshalling user %s: %v", user.ID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// Login verifies a username and password and issues an access token and
+// a refresh token
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	var creds Credentials
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&creds); err != nil {
+		reqLog(r).Errorf("error decoding login request: %v", err)
+		writeError(w, r, http.StatusBadRequest, "request body is not valid JSON")
+		return
+	}
+
+	if len(creds.Password) > maxPasswordLen {
+		writeError(w, r, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	user, err := s.db.VerifyUser(r.Context(), creds.Username, creds.Password)
+	if errors.Is(err, db.ErrInvalidCredentials) {
+		writeError(w, r, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error verifying user %s", creds.Username))
+		return
+	}
+
+	refresh, err := auth.NewRefreshToken()
+	if err != nil {
+		reqLog(r).Errorf("error generating refresh token for user %s: %v", user.ID, err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	if err := s.db.CreateRefreshToken(r.Context(), user.ID, refresh, time.Now().Add(s.tokenIssuer().RefreshTTL())); err != nil {
+		writeStoreError(w, r, err, fmt.Sprintf("error storing refresh token for user %s", user.ID))
+		return
+	}
+
+	s.writeTokens(w, r, user.ID, refresh)
+}
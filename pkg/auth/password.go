@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters, following the OWASP recommendation of 19 MiB of
+// memory and two passes. These are encoded into every hash so they can be
+// raised later without invalidating existing passwords.
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+
+	// Stored hashes asking for more than this are rejected rather than
+	// derived, a tampered row shouldn't be able to exhaust the server
+	maxArgonMemory = 256 * 1024
+	maxArgonTime   = 16
+)
+
+var (
+	// ErrMismatchedPassword is returned when a password does not match its hash
+	ErrMismatchedPassword = errors.New("password does not match hash")
+	// ErrInvalidHash is returned when a stored hash cannot be parsed
+	ErrInvalidHash = errors.New("invalid password hash")
+)
+
+// HashPassword derives a salted argon2id hash of the password, encoded in the
+// PHC string format, e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// ComparePassword checks a password against a hash produced by HashPassword.
+// It returns nil on a match and ErrMismatchedPassword otherwise.
+func ComparePassword(hash, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return ErrInvalidHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return ErrInvalidHash
+	}
+	// argon2 panics on zero time or threads
+	if time == 0 || time > maxArgonTime || threads == 0 || memory == 0 || memory > maxArgonMemory {
+		return ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return ErrInvalidHash
+	}
+	// An empty key would match the empty key derived from any password
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return ErrInvalidHash
+	}
+
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatchedPassword
+	}
+	return nil
+}
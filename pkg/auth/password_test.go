@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	require.NoError(t, err)
+
+	require.NoError(t, ComparePassword(hash, "correct horse"))
+	require.ErrorIs(t, ComparePassword(hash, "battery staple"), ErrMismatchedPassword)
+	require.ErrorIs(t, ComparePassword("not a hash", "correct horse"), ErrInvalidHash)
+
+	// Corrupt hashes never verify, and never reach argon2
+	salt, key := "c2FsdHNhbHRzYWx0c2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, bad := range []string{
+		"$argon2id$v=19$m=19456,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=19456,t=2,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=0,t=2,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=4194304,t=2,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$",
+		"$argon2id$v=19$m=19456,t=2,p=1$$" + key,
+	} {
+		require.ErrorIs(t, ComparePassword(bad, "correct horse"), ErrInvalidHash, bad)
+	}
+
+	// Salts should make every hash unique
+	other, err := HashPassword("correct horse")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+}
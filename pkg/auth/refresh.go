@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// refreshTokenLen is the number of random bytes in a refresh token
+const refreshTokenLen = 32
+
+// NewRefreshToken generates a random opaque refresh token
+func NewRefreshToken() (string, error) {
+	b := make([]byte, refreshTokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating refresh token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashRefreshToken returns the digest under which a refresh token is stored.
+// Refresh tokens are high entropy, so unlike passwords a fast unsalted hash
+// is enough and lets the token itself be used as the lookup key.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Supported token signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// minHMACKeyLen is the minimum HS256 secret length, matching the hash size
+const minHMACKeyLen = 32
+
+// ErrInvalidToken is returned for any token that fails verification
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenIssuer signs and verifies JWT access tokens, and sets the lifetime of
+// the opaque refresh tokens handed out alongside them
+type TokenIssuer struct {
+	method     jwt.SigningMethod
+	signKey    interface{}
+	verifyKey  interface{}
+	issuer     string
+	ttl        time.Duration
+	refreshTTL time.Duration
+}
+
+// NewTokenIssuer creates a TokenIssuer for the given algorithm. For HS256 the
+// key is the shared secret; for RS256 and EdDSA it is a PEM encoded private key.
+func NewTokenIssuer(alg string, key []byte, issuer string, ttl, refreshTTL time.Duration) (*TokenIssuer, error) {
+	if ttl <= 0 {
+		return nil, errors.New("token ttl must be positive")
+	}
+	if refreshTTL <= 0 {
+		return nil, errors.New("refresh token ttl must be positive")
+	}
+
+	t := &TokenIssuer{
+		issuer:     issuer,
+		ttl:        ttl,
+		refreshTTL: refreshTTL,
+	}
+
+	switch alg {
+	case AlgHS256:
+		if len(key) < minHMACKeyLen {
+			return nil, fmt.Errorf("hmac key must be at least %d bytes", minHMACKeyLen)
+		}
+		t.method = jwt.SigningMethodHS256
+		t.signKey = key
+		t.verifyKey = key
+	case AlgRS256:
+		priv, err := jwt.ParseRSAPrivateKeyFromPEM(key)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing rsa key: %v", err)
+		}
+		t.method = jwt.SigningMethodRS256
+		t.signKey = priv
+		t.verifyKey = priv.Public().(*rsa.PublicKey)
+	case AlgEdDSA:
+		priv, err := jwt.ParseEdPrivateKeyFromPEM(key)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ed25519 key: %v", err)
+		}
+		t.method = jwt.SigningMethodEdDSA
+		t.signKey = priv
+		t.verifyKey = priv.(crypto.Signer).Public().(ed25519.PublicKey)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	return t, nil
+}
+
+// TTL returns how long issued tokens are valid for
+func (t *TokenIssuer) TTL() time.Duration {
+	return t.ttl
+}
+
+// RefreshTTL returns how long issued refresh tokens are valid for
+func (t *TokenIssuer) RefreshTTL() time.Duration {
+	return t.refreshTTL
+}
+
+// Issue signs a new access token for the given user ID
+func (t *TokenIssuer) Issue(userID string) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(t.ttl)
+
+	claims := jwt.RegisteredClaims{
+		Issuer:    t.issuer,
+		Subject:   userID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(exp),
+	}
+
+	signed, err := jwt.NewWithClaims(t.method, claims).SignedString(t.signKey)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error signing token: %v", err)
+	}
+	return signed, exp, nil
+}
+
+// Verify checks a token's signature, algorithm, issuer and expiry, and
+// returns the user ID it was issued for
+func (t *TokenIssuer) Verify(token string) (string, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{t.method.Alg()}))
+
+	claims := &jwt.RegisteredClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return t.verifyKey, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if !claims.VerifyIssuer(t.issuer, true) {
+		return "", fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if claims.ExpiresAt == nil {
+		return "", fmt.Errorf("%w: missing expiry", ErrInvalidToken)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+
+	return claims.Subject, nil
+}
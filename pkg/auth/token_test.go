@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenRoundTrip(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	edKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	for alg, key := range map[string][]byte{
+		AlgHS256: []byte("0123456789abcdef0123456789abcdef"),
+		AlgEdDSA: edKey,
+	} {
+		issuer, err := NewTokenIssuer(alg, key, "haiku-auth", time.Minute, time.Hour)
+		require.NoError(t, err, alg)
+
+		token, exp, err := issuer.Issue("user-1")
+		require.NoError(t, err, alg)
+		require.WithinDuration(t, time.Now().Add(time.Minute), exp, time.Second)
+
+		sub, err := issuer.Verify(token)
+		require.NoError(t, err, alg)
+		require.Equal(t, "user-1", sub)
+
+		_, err = issuer.Verify(token + "x")
+		require.ErrorIs(t, err, ErrInvalidToken, alg)
+	}
+}
+
+func TestTokenRejectsOtherIssuer(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	a, err := NewTokenIssuer(AlgHS256, key, "a", time.Minute, time.Hour)
+	require.NoError(t, err)
+	b, err := NewTokenIssuer(AlgHS256, key, "b", time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	token, _, err := a.Issue("user-1")
+	require.NoError(t, err)
+	_, err = b.Verify(token)
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -13,39 +17,207 @@ type APIConfig struct {
 	Port         int
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// ShutdownDelay is how long the server keeps serving with failing
+	// readiness checks once asked to stop, so it's taken out of load
+	// balancing first, and ShutdownTimeout is how long in-flight requests
+	// then get to finish
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+	// RateLimit is the requests a second each client IP may make, with
+	// bursts of up to RateBurst, unlimited if 0
+	RateLimit float64
+	RateBurst int
+
+	// TLSCert and TLSKey switch the server to HTTPS. The files are reloaded
+	// when they change.
+	TLSCert string
+	TLSKey  string
+	// TLSMinVersion is 1.2 or 1.3
+	TLSMinVersion string
+	// TLSCiphers is a comma separated list of TLS 1.2 cipher suites by
+	// their IANA names, or empty for Go's defaults
+	TLSCiphers string
+	// HTTPRedirectPort, if set, serves redirects from plain HTTP to HTTPS
+	HTTPRedirectPort int
+
+	// TLSClientCA is a PEM bundle of CAs that internal services' client
+	// certificates are signed by, client certificates are off if empty
+	TLSClientCA string
+	// Services maps service identities to their certificate names, e.g.
+	// notes-web: [uri:spiffe://cluster/ns/web/sa/notes-web], and
+	// ServiceRoutes limits route templates to lists of those services. Both
+	// only come from the config file.
+	Services      map[string][]string
+	ServiceRoutes map[string][]string
 }
 
-// NewAPIConfig ...
-func NewAPIConfig() (*APIConfig, error) {
-	viper.GetViper().SetEnvPrefix("api")
+// tlsVersions maps the accepted TLS minimum versions to their IDs
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// apiFlags registers the api flags along with their defaults
+func apiFlags(fs *pflag.FlagSet) {
+	fs.String("api-host", "", "address to listen on, all interfaces if empty")
+	fs.Int("api-port", 8080, "port to listen on")
+	fs.Duration("api-read-timeout", 30*time.Second, "maximum time to read a request")
+	fs.Duration("api-write-timeout", 30*time.Second, "maximum time to write a response")
+	// Kubernetes kills the pod 30s after SIGTERM by default, so the delay
+	// and timeout together leave some headroom for closing the db
+	fs.Duration("api-shutdown-delay", 5*time.Second, "time to keep serving with failing readiness checks on shutdown")
+	fs.Duration("api-shutdown-timeout", 20*time.Second, "time in-flight requests get to finish on shutdown")
+	fs.Float64("api-rate-limit", 0, "requests a second each client IP may make, unlimited if 0")
+	fs.Int("api-rate-burst", 20, "requests a client IP may make at once before the rate limit applies")
+	fs.String("api-tls-cert", "", "PEM certificate chain, serves HTTPS when set with the key")
+	fs.String("api-tls-key", "", "PEM private key for the certificate")
+	fs.String("api-tls-min-version", "1.2", "lowest TLS version accepted: 1.2 or 1.3")
+	fs.String("api-tls-ciphers", "", "comma separated TLS 1.2 cipher suites, Go's defaults if empty")
+	fs.Int("api-http-redirect-port", 0, "port redirecting plain HTTP to HTTPS, off if 0")
+	fs.String("api-tls-client-ca", "", "PEM CA bundle for service client certificates, off if empty")
+}
 
-	host := viper.GetString("host")
-	if host == "" {
-		log.Info("undefined api host, defaulting to :http")
+// newAPIConfig reads the api config from v
+func newAPIConfig(v *viper.Viper) *APIConfig {
+	return &APIConfig{
+		Host:             v.GetString("api.host"),
+		Port:             v.GetInt("api.port"),
+		ReadTimeout:      v.GetDuration("api.read_timeout"),
+		WriteTimeout:     v.GetDuration("api.write_timeout"),
+		ShutdownDelay:    v.GetDuration("api.shutdown_delay"),
+		ShutdownTimeout:  v.GetDuration("api.shutdown_timeout"),
+		RateLimit:        v.GetFloat64("api.rate_limit"),
+		RateBurst:        v.GetInt("api.rate_burst"),
+		TLSCert:          v.GetString("api.tls_cert"),
+		TLSKey:           v.GetString("api.tls_key"),
+		TLSMinVersion:    v.GetString("api.tls_min_version"),
+		TLSCiphers:       v.GetString("api.tls_ciphers"),
+		HTTPRedirectPort: v.GetInt("api.http_redirect_port"),
+		TLSClientCA:      v.GetString("api.tls_client_ca"),
+		Services:         v.GetStringMapStringSlice("api.services"),
+		ServiceRoutes:    v.GetStringMapStringSlice("api.service_routes"),
 	}
+}
 
-	port := viper.GetInt("port")
-	if port == 0 {
-		log.Info("undefined api port, defaulting to 8080")
-		port = 8080
+// problems lists everything wrong with the api config
+func (c *APIConfig) problems() []string {
+	var problems []string
+	if c.Port < 1 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("api port %d is out of range", c.Port))
+	}
+	if c.ReadTimeout <= 0 {
+		problems = append(problems, "api read timeout must be positive")
+	}
+	if c.WriteTimeout <= 0 {
+		problems = append(problems, "api write timeout must be positive")
+	}
+	if c.ShutdownDelay < 0 {
+		problems = append(problems, "api shutdown delay can't be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "api shutdown timeout must be positive")
+	}
+	if c.RateLimit < 0 {
+		problems = append(problems, "api rate limit can't be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		problems = append(problems, "api rate burst must be at least 1")
 	}
 
-	rt := viper.GetDuration("read_timeout")
-	if rt == 0 {
-		log.Info("undefined api read timeout, defaulting to 30s")
-		rt = 30 * time.Second
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problems = append(problems, "api tls cert and key must be set together")
+	}
+	for _, file := range []struct{ key, path string }{
+		{"tls cert", c.TLSCert},
+		{"tls key", c.TLSKey},
+		{"tls client ca", c.TLSClientCA},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problems = append(problems, fmt.Sprintf("api %s: %v", file.key, err))
+		}
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+		problems = append(problems, fmt.Sprintf("unsupported api tls min version %q", c.TLSMinVersion))
+	}
+	if _, err := cipherSuites(c.TLSCiphers); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.HTTPRedirectPort != 0 {
+		switch {
+		case c.HTTPRedirectPort < 0 || c.HTTPRedirectPort > 65535:
+			problems = append(problems, fmt.Sprintf("api http redirect port %d is out of range", c.HTTPRedirectPort))
+		case c.TLSCert == "":
+			problems = append(problems, "api http redirect port needs tls")
+		case c.HTTPRedirectPort == c.Port:
+			problems = append(problems, "api http redirect port must differ from the api port")
+		}
 	}
+	return append(problems, c.servicePolicyProblems()...)
+}
 
-	wt := viper.GetDuration("write_timeout")
-	if wt == 0 {
-		log.Info("undefined api write timeout, defaulting to 30s")
-		wt = 30 * time.Second
+// servicePolicyProblems lists everything wrong with the client certificate
+// settings that can be told without the router. Certificate names and
+// routes are checked by EnableTLS.
+func (c *APIConfig) servicePolicyProblems() []string {
+	var problems []string
+	if c.TLSClientCA == "" {
+		if len(c.Services) > 0 || len(c.ServiceRoutes) > 0 {
+			problems = append(problems, "api services and service routes need a tls client ca")
+		}
+		return problems
+	}
+	if c.TLSCert == "" {
+		problems = append(problems, "api tls client ca needs tls")
 	}
+	for service, names := range c.Services {
+		if len(names) == 0 {
+			problems = append(problems, fmt.Sprintf("api service %s has no certificate names", service))
+		}
+	}
+	return problems
+}
 
-	return &APIConfig{
-		Host:         host,
-		Port:         port,
-		ReadTimeout:  rt,
-		WriteTimeout: wt,
-	}, nil
+// TLSEnabled reports whether the server should serve HTTPS
+func (c *APIConfig) TLSEnabled() bool {
+	return c.TLSCert != ""
+}
+
+// TLSVersion returns the ID of the TLS min version of a validated config
+func (c *APIConfig) TLSVersion() uint16 {
+	return tlsVersions[c.TLSMinVersion]
+}
+
+// CipherSuites returns the IDs of the TLS 1.2 cipher suites of a validated
+// config, or nil for Go's defaults
+func (c *APIConfig) CipherSuites() []uint16 {
+	// Checked by Validate
+	suites, _ := cipherSuites(c.TLSCiphers)
+	return suites
+}
+
+// cipherSuites parses a comma separated list of cipher suite names. Only
+// suites Go considers secure are accepted.
+func cipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+
+	ids := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported api tls cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
 }
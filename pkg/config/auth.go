@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+)
+
+// AuthConfig ...
+type AuthConfig struct {
+	Algorithm  string
+	SigningKey Secret
+	Issuer     string
+	TokenTTL   time.Duration
+	RefreshTTL time.Duration
+}
+
+// authFlags registers the auth flags along with their defaults
+func authFlags(fs *pflag.FlagSet) {
+	fs.String("auth-algorithm", auth.AlgHS256, "token signing algorithm: HS256, RS256 or EdDSA")
+	fs.String("auth-signing-key", "", "HMAC secret or PEM encoded private key")
+	fs.String("auth-issuer", "haiku-auth", "iss claim of issued tokens")
+	fs.Duration("auth-token-ttl", 15*time.Minute, "access token lifetime")
+	fs.Duration("auth-refresh-ttl", 30*24*time.Hour, "refresh token lifetime")
+}
+
+// newAuthConfig reads the auth config from v
+func newAuthConfig(v *viper.Viper) *AuthConfig {
+	return &AuthConfig{
+		Algorithm:  v.GetString("auth.algorithm"),
+		SigningKey: Secret(v.GetString("auth.signing_key")),
+		Issuer:     v.GetString("auth.issuer"),
+		TokenTTL:   v.GetDuration("auth.token_ttl"),
+		RefreshTTL: v.GetDuration("auth.refresh_ttl"),
+	}
+}
+
+// problems lists everything wrong with the auth config
+func (c *AuthConfig) problems() []string {
+	var problems []string
+	validAlg := true
+	switch c.Algorithm {
+	case auth.AlgHS256, auth.AlgRS256, auth.AlgEdDSA:
+	default:
+		validAlg = false
+		problems = append(problems, fmt.Sprintf("unsupported auth algorithm %q", c.Algorithm))
+	}
+	if len(c.SigningKey) == 0 {
+		problems = append(problems, "undefined auth signing key")
+	} else if validAlg {
+		// Parsing the key is the only way to check it suits the algorithm.
+		// The error never includes the key.
+		if _, err := auth.NewTokenIssuer(c.Algorithm, []byte(c.SigningKey), c.Issuer, time.Minute, time.Minute); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid auth signing key: %v", err))
+		}
+	}
+	if c.Issuer == "" {
+		problems = append(problems, "undefined auth issuer")
+	}
+	if c.TokenTTL <= 0 {
+		problems = append(problems, "auth token ttl must be positive")
+	}
+	if c.RefreshTTL <= 0 {
+		problems = append(problems, "auth refresh ttl must be positive")
+	}
+	return problems
+}
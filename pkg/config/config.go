@@ -2,34 +2,126 @@ package config
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-// Config holds all env var config required by haiku-auth
+// Config holds all config required by haiku-auth
 type Config struct {
-	API *APIConfig
-	DB  *DBConfig
+	API  *APIConfig
+	Auth *AuthConfig
+	DB   *DBConfig
+	Log  *LogConfig
+	// Reload applies changes to the config file and secret files to the
+	// running server, see Watch
+	Reload bool
+
+	// name and args are what the config was loaded from, for reloading
+	name string
+	args []string
+	// file is the config file, if any
+	file string
+	// secretFiles maps the keys read from secret files to their paths
+	secretFiles map[string]string
 }
 
-// DefaultConfig returns sane defaults for commonly used deployment envs
-func DefaultConfig() (*Config, error) {
-	// This binds the environment to viper for reading env var config
-	viper.AutomaticEnv()
+// ValidationError lists every problem found with a config, so they can all
+// be fixed in one go
+type ValidationError struct {
+	Problems []string
+}
 
-	apiConfig, err := NewAPIConfig()
-	if err != nil {
-		return nil, fmt.Errorf("error reading api config: %v", err)
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// validationError returns a *ValidationError for problems, or nil if there
+// aren't any
+func validationError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// Load reads config from an optional YAML or TOML file, then environment
+// variables, then command line flags, each overriding the last. The file is
+// given by the --config flag or the CONFIG_FILE environment variable, and
+// its keys are the lowercase env var names split at the first underscore,
+// e.g. db.password for DB_PASSWORD. Secrets can also be read from files, see
+// secretKeys. Load returns the arguments left over after parsing flags. The
+// config isn't validated.
+func Load(name string, args []string) (*Config, []string, error) {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	file := fs.String("config", "", "path to a YAML or TOML config file")
+	fs.Bool("config-reload", false, "apply changes to the config and secret files without a restart")
+	apiFlags(fs)
+	authFlags(fs)
+	dbFlags(fs)
+	logFlags(fs)
+	secretFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
 	}
 
-	dbConfig, err := NewDBConfig()
+	// A viper per load keeps env prefixes and bindings from leaking between
+	// loads, which the global instance doesn't
+	v := viper.New()
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	var bindErr error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" || bindErr != nil {
+			return
+		}
+		// Flags are named like api-read-timeout for the api.read_timeout key
+		key := strings.Replace(strings.ReplaceAll(f.Name, "-", "_"), "_", ".", 1)
+		bindErr = v.BindPFlag(key, f)
+	})
+	if bindErr != nil {
+		return nil, nil, fmt.Errorf("error binding flags: %v", bindErr)
+	}
+
+	if !fs.Changed("config") {
+		*file = v.GetString("config_file")
+	}
+	if *file != "" {
+		v.SetConfigFile(*file)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, nil, fmt.Errorf("error reading config file %s: %v", *file, err)
+		}
+	}
+
+	secretFiles, err := loadSecrets(v)
 	if err != nil {
-		return nil, fmt.Errorf("error reading db config: %v", err)
+		return nil, nil, err
 	}
 
 	c := &Config{
-		API: apiConfig,
-		DB:  dbConfig,
+		API:         newAPIConfig(v),
+		Auth:        newAuthConfig(v),
+		DB:          newDBConfig(v),
+		Log:         newLogConfig(v),
+		Reload:      v.GetBool("config.reload"),
+		name:        name,
+		args:        args,
+		file:        *file,
+		secretFiles: secretFiles,
 	}
-	return c, nil
+	return c, fs.Args(), nil
+}
+
+// Validate checks the whole config and reports every problem at once as a
+// *ValidationError
+func (c *Config) Validate() error {
+	var problems []string
+	problems = append(problems, c.API.problems()...)
+	problems = append(problems, c.Auth.problems()...)
+	problems = append(problems, c.DB.problems()...)
+	problems = append(problems, c.Log.problems()...)
+	return validationError(problems)
 }
@@ -1,10 +1,14 @@
 package config
 
 import (
-	"errors"
+	"fmt"
+	"os"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
 )
 
 // DBConfig ...
@@ -13,44 +17,193 @@ type DBConfig struct {
 	Port     int
 	Database string
 	User     string
-	Pass     string
+	Pass     Secret
+	// DSN is a full connection string or postgres:// URL. Settings given
+	// explicitly alongside it override the same settings in it.
+	DSN Secret
+
+	// SSLMode is one of disable, require, verify-ca or verify-full
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// ConnectTimeout is how long to keep retrying the initial connection
+	// while postgres starts up, and RetryInitialDelay and RetryMaxDelay
+	// bound the backoff between attempts
+	ConnectTimeout    time.Duration
+	RetryInitialDelay time.Duration
+	RetryMaxDelay     time.Duration
+
+	// QueryTimeout bounds every query, and should be well under the API
+	// write timeout
+	QueryTimeout time.Duration
+	// AutoMigrate applies pending schema migrations on startup
+	AutoMigrate bool
 }
 
-// NewDBConfig ...
-func NewDBConfig() (*DBConfig, error) {
-	viper.GetViper().SetEnvPrefix("db")
+// dbFlags registers the db flags along with their defaults
+func dbFlags(fs *pflag.FlagSet) {
+	fs.String("db-host", "localhost", "postgres host")
+	fs.Int("db-port", 5432, "postgres port")
+	fs.String("db-database", "", "postgres database name")
+	fs.String("db-user", "", "postgres user")
+	fs.String("db-password", "", "postgres password")
+	fs.String("db-dsn", "", "postgres connection string or URL, instead of the settings above")
+	fs.String("db-sslmode", "", "disable, require, verify-ca or verify-full (default disable, unless set by the dsn)")
+	fs.String("db-sslrootcert", "", "CA bundle to verify the postgres server certificate")
+	fs.String("db-sslcert", "", "client certificate for postgres")
+	fs.String("db-sslkey", "", "client certificate private key for postgres")
+	fs.Int("db-max-open-conns", 0, "maximum open connections, 0 for unlimited")
+	fs.Int("db-max-idle-conns", 0, "maximum idle connections, 0 for the default of 2")
+	fs.Duration("db-conn-max-lifetime", 0, "maximum time a connection is reused, 0 for unlimited")
+	fs.Duration("db-conn-max-idle-time", 0, "maximum time a connection sits idle, 0 for unlimited")
+	fs.Duration("db-connect-timeout", time.Minute, "how long to keep retrying the initial connection, 0 to try once")
+	fs.Duration("db-retry-initial-delay", 500*time.Millisecond, "wait after the first failed connection attempt, doubling after each one")
+	fs.Duration("db-retry-max-delay", 10*time.Second, "longest wait between connection attempts")
+	fs.Duration("db-query-timeout", 5*time.Second, "maximum time for a single query")
+	fs.Bool("db-auto-migrate", false, "apply pending schema migrations on startup")
+}
 
-	host := viper.GetString("host")
-	if host == "" {
-		log.Info("undefined db host, defaulting to localhost")
-		host = "localhost"
+// newDBConfig reads the db config from v
+func newDBConfig(v *viper.Viper) *DBConfig {
+	c := &DBConfig{
+		Host:              v.GetString("db.host"),
+		Port:              v.GetInt("db.port"),
+		Database:          v.GetString("db.database"),
+		User:              v.GetString("db.user"),
+		Pass:              Secret(v.GetString("db.password")),
+		DSN:               Secret(v.GetString("db.dsn")),
+		SSLMode:           v.GetString("db.sslmode"),
+		SSLRootCert:       v.GetString("db.sslrootcert"),
+		SSLCert:           v.GetString("db.sslcert"),
+		SSLKey:            v.GetString("db.sslkey"),
+		MaxOpenConns:      v.GetInt("db.max_open_conns"),
+		MaxIdleConns:      v.GetInt("db.max_idle_conns"),
+		ConnMaxLifetime:   v.GetDuration("db.conn_max_lifetime"),
+		ConnMaxIdleTime:   v.GetDuration("db.conn_max_idle_time"),
+		ConnectTimeout:    v.GetDuration("db.connect_timeout"),
+		RetryInitialDelay: v.GetDuration("db.retry_initial_delay"),
+		RetryMaxDelay:     v.GetDuration("db.retry_max_delay"),
+		QueryTimeout:      v.GetDuration("db.query_timeout"),
+		AutoMigrate:       v.GetBool("db.auto_migrate"),
 	}
-
-	port := viper.GetInt("port")
-	if port == 0 {
-		log.Info("undefined db port, defaulting to 5432")
-		port = 5432
+	// Defaults mustn't override the host and port in a DSN, only explicit
+	// settings
+	if c.DSN != "" {
+		if !v.IsSet("db.host") {
+			c.Host = ""
+		}
+		if !v.IsSet("db.port") {
+			c.Port = 0
+		}
 	}
+	return c
+}
 
-	database := viper.GetString("database")
-	if database == "" {
-		return nil, errors.New("undefined db database")
-	}
+// Validate checks only the db config, for commands that don't run the API
+// server. It reports every problem at once as a *ValidationError.
+func (c *DBConfig) Validate() error {
+	return validationError(c.problems())
+}
 
-	user := viper.GetString("user")
-	if user == "" {
-		return nil, errors.New("undefined db user")
+// problems lists everything wrong with the db config
+func (c *DBConfig) problems() []string {
+	var problems []string
+	// A DSN can hold any of the connection settings, leave it to postgres
+	// to complain about missing ones
+	if c.DSN == "" {
+		if c.Host == "" {
+			problems = append(problems, "undefined db host")
+		}
+		if c.Database == "" {
+			problems = append(problems, "undefined db database")
+		}
+		if c.User == "" {
+			problems = append(problems, "undefined db user")
+		}
+		if c.Pass == "" {
+			problems = append(problems, "undefined db password")
+		}
+	}
+	if (c.DSN == "" || c.Port != 0) && (c.Port < 1 || c.Port > 65535) {
+		problems = append(problems, fmt.Sprintf("db port %d is out of range", c.Port))
+	}
+	switch c.SSLMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported db sslmode %q", c.SSLMode))
 	}
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		problems = append(problems, "db sslcert and sslkey must be set together")
+	}
+	for _, file := range []struct{ key, path string }{
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problems = append(problems, fmt.Sprintf("db %s: %v", file.key, err))
+		}
+	}
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 {
+		problems = append(problems, "db connection limits can't be negative")
+	}
+	if c.MaxOpenConns > 0 && c.MaxIdleConns > c.MaxOpenConns {
+		problems = append(problems, "db max idle conns can't exceed max open conns")
+	}
+	if c.ConnMaxLifetime < 0 || c.ConnMaxIdleTime < 0 {
+		problems = append(problems, "db connection lifetimes can't be negative")
+	}
+	if c.ConnectTimeout < 0 {
+		problems = append(problems, "db connect timeout can't be negative")
+	}
+	if c.RetryInitialDelay <= 0 || c.RetryMaxDelay < c.RetryInitialDelay {
+		problems = append(problems, "db retry delays must be positive, with the max at least the initial one")
+	}
+	if c.QueryTimeout <= 0 {
+		problems = append(problems, "db query timeout must be positive")
+	}
+	return problems
+}
 
-	pass := viper.GetString("password")
-	if pass == "" {
-		return nil, errors.New("undefined db password")
+// Options returns the options for connecting to the db
+func (c *DBConfig) Options() db.Options {
+	return db.Options{
+		Host:         c.Host,
+		Port:         c.Port,
+		User:         c.User,
+		Password:     string(c.Pass),
+		Database:     c.Database,
+		DSN:          string(c.DSN),
+		SSLMode:      c.SSLMode,
+		SSLRootCert:  c.SSLRootCert,
+		SSLCert:      c.SSLCert,
+		SSLKey:       c.SSLKey,
+		QueryTimeout: c.QueryTimeout,
+		Pool:         c.Pool(),
+		Retry: db.Retry{
+			Timeout:      c.ConnectTimeout,
+			InitialDelay: c.RetryInitialDelay,
+			MaxDelay:     c.RetryMaxDelay,
+		},
 	}
+}
 
-	return &DBConfig{
-		Host: host,
-		Port: port,
-		User: user,
-		Pass: pass,
-	}, nil
+// Pool returns the connection pool limits
+func (c *DBConfig) Pool() db.Pool {
+	return db.Pool{
+		MaxOpenConns:    c.MaxOpenConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxLifetime: c.ConnMaxLifetime,
+		ConnMaxIdleTime: c.ConnMaxIdleTime,
+	}
 }
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// LogConfig ...
+type LogConfig struct {
+	Level string
+}
+
+// logFlags registers the log flags along with their defaults
+func logFlags(fs *pflag.FlagSet) {
+	fs.String("log-level", log.InfoLevel.String(), "minimum level to log: debug, info, warn or error")
+}
+
+// newLogConfig reads the log config from v
+func newLogConfig(v *viper.Viper) *LogConfig {
+	return &LogConfig{
+		Level: v.GetString("log.level"),
+	}
+}
+
+// problems lists everything wrong with the log config
+func (c *LogConfig) problems() []string {
+	if _, err := log.ParseLevel(c.Level); err != nil {
+		return []string{fmt.Sprintf("unknown log level %q", c.Level)}
+	}
+	return nil
+}
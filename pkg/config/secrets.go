@@ -0,0 +1,161 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Secret is a config value that must never be logged. It formats as
+// [redacted], use string(s) for the real value.
+type Secret string
+
+func (s Secret) String() string {
+	return "[redacted]"
+}
+
+// GoString keeps %#v from printing the value
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalText keeps encoders from printing the value
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// secretKeys can be read from files rather than plain config, either by
+// setting the key with a _file suffix, e.g. DB_PASSWORD_FILE, or by putting
+// a file named after the env var, e.g. DB_PASSWORD, in the secrets dir
+var secretKeys = []string{"auth.signing_key", "db.user", "db.password", "db.dsn"}
+
+// secretFlags registers the flags pointing at secret files
+func secretFlags(fs *pflag.FlagSet) {
+	fs.String("secrets-dir", "", "directory of secret files named after their env vars, e.g. DB_PASSWORD")
+	for _, key := range secretKeys {
+		flag := strings.ReplaceAll(key, "_", "-")
+		flag = strings.ReplaceAll(flag, ".", "-")
+		fs.String(flag+"-file", "", fmt.Sprintf("file containing %s", key))
+	}
+}
+
+// envName returns the environment variable for a config key
+func envName(key string) string {
+	return strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// secretFile returns the file a secret should be read from, if any. An
+// explicit _file setting wins over a plain value, which wins over the
+// secrets dir.
+func secretFile(v *viper.Viper, key string) string {
+	if file := v.GetString(key + "_file"); file != "" {
+		return file
+	}
+	if v.IsSet(key) {
+		return ""
+	}
+	dir := v.GetString("secrets.dir")
+	if dir == "" {
+		return ""
+	}
+	file := filepath.Join(dir, envName(key))
+	if _, err := os.Stat(file); err != nil {
+		return ""
+	}
+	return file
+}
+
+// readSecret reads a secret file, ignoring the trailing newline most editors
+// and `kubectl create secret --from-file` leave behind
+func readSecret(file string) (Secret, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return Secret(strings.TrimRight(string(b), "\r\n")), nil
+}
+
+// loadSecrets reads every secret that comes from a file into v, and returns
+// the files by key
+func loadSecrets(v *viper.Viper) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, key := range secretKeys {
+		file := secretFile(v, key)
+		if file == "" {
+			continue
+		}
+		s, err := readSecret(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", key, err)
+		}
+		v.Set(key, string(s))
+		files[key] = file
+	}
+	return files, nil
+}
+
+// SecretWatcher re-reads secret files when they change on disk
+type SecretWatcher struct {
+	*fileWatcher
+	files    map[string]string
+	onChange func(key string, value Secret)
+
+	mu     sync.Mutex
+	values map[string]Secret
+}
+
+// WatchSecrets calls onChange with the new value whenever one of the secret
+// files the config was loaded from changes
+func (c *Config) WatchSecrets(onChange func(key string, value Secret)) (*SecretWatcher, error) {
+	w := &SecretWatcher{
+		files:    c.secretFiles,
+		onChange: onChange,
+		values:   make(map[string]Secret),
+	}
+
+	var files []string
+	for key, file := range c.secretFiles {
+		s, err := readSecret(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", key, err)
+		}
+		w.values[key] = s
+		files = append(files, file)
+	}
+
+	fw, err := watchFiles(files, w.reload)
+	if err != nil {
+		return nil, err
+	}
+	w.fileWatcher = fw
+	return w, nil
+}
+
+// reload reads every secret file and reports the ones that changed. It's
+// cheap, and saves mapping symlink swaps back to the files they affect.
+func (w *SecretWatcher) reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for key, file := range w.files {
+		s, err := readSecret(file)
+		if err != nil {
+			// Files briefly disappear while a symlink is swapped, the next
+			// event will pick up the new one
+			log.Debugf("error re-reading %s: %v", key, err)
+			continue
+		}
+		if s == w.values[key] {
+			continue
+		}
+		w.values[key] = s
+		log.Infof("secret %s changed", key)
+		w.onChange(key, s)
+	}
+}
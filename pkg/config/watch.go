@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileWatcher calls onEvent whenever anything changes in the directories
+// holding a set of files. Directories are watched rather than the files
+// themselves, since editors and Kubernetes replace files rather than
+// writing to them, which ends a watch on the file.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// watchFiles starts watching the directories of files
+func watchFiles(files []string, onEvent func()) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating file watcher: %v", err)
+	}
+
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("error watching %s: %v", dir, err)
+		}
+	}
+
+	w := &fileWatcher{
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+	go w.run(onEvent)
+	return w, nil
+}
+
+func (w *fileWatcher) run(onEvent func()) {
+	defer close(w.done)
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			onEvent()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("error watching config files: %v", err)
+		}
+	}
+}
+
+// Close stops watching for changes
+func (w *fileWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+// Watcher reloads the whole config when the config file or a secret file
+// changes
+type Watcher struct {
+	*fileWatcher
+	onChange func(*Config)
+
+	mu      sync.Mutex
+	current *Config
+}
+
+// Watch reloads the config whenever the config file or one of its secret
+// files changes, from the same flags and environment it was first loaded
+// with. onChange is called with each new config that passes Validate.
+// Invalid configs are logged and ignored, leaving the old one in effect.
+func (c *Config) Watch(onChange func(*Config)) (*Watcher, error) {
+	var files []string
+	if c.file != "" {
+		files = append(files, c.file)
+	}
+	for _, file := range c.secretFiles {
+		files = append(files, file)
+	}
+
+	w := &Watcher{
+		onChange: onChange,
+		current:  c,
+	}
+	fw, err := watchFiles(files, w.reload)
+	if err != nil {
+		return nil, err
+	}
+	w.fileWatcher = fw
+	return w, nil
+}
+
+// reload loads and validates the config again, and reports it if it changed
+func (w *Watcher) reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next, _, err := Load(w.current.name, w.current.args)
+	if err != nil {
+		log.Errorf("error reloading config, keeping the old one: %v", err)
+		return
+	}
+	if err := next.Validate(); err != nil {
+		log.Errorf("rejected reloaded config, keeping the old one: %v", err)
+		return
+	}
+	if reflect.DeepEqual(next, w.current) {
+		return
+	}
+
+	w.current = next
+	log.Info("config reloaded")
+	w.onChange(next)
+}
@@ -1,30 +1,314 @@
 package db
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	mrand "math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/voyagerstudio/haiku-auth/pkg/db/migrate"
+	"github.com/voyagerstudio/haiku-auth/pkg/requestid"
 )
 
 type Conn struct {
-	conn *sql.DB
+	conn      *sql.DB
+	connector *connector
+	// migrator reads the schema version for readiness checks
+	migrator *migrate.Migrator
 }
 
-// New initializes a new database connection
-func New(host string, port int, user, password, database string) (*Conn, error) {
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, database)
-	conn, err := sql.Open("postgres", connStr)
+// Options configures a connection to postgres
+type Options struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+	// DSN is a full key=value connection string or postgres:// URL. Any
+	// other option that's set overrides the same setting in it.
+	DSN string
+
+	// SSLMode is one of disable, require, verify-ca or verify-full. It
+	// defaults to disable, unless DSN sets it.
+	SSLMode string
+	// SSLRootCert is the CA bundle used to verify the server certificate
+	SSLRootCert string
+	// SSLCert and SSLKey are the client certificate and its private key
+	SSLCert string
+	SSLKey  string
+
+	// QueryTimeout bounds every query, both by its context and by postgres'
+	// statement_timeout. 0 means no limit.
+	QueryTimeout time.Duration
+
+	Pool  Pool
+	Retry Retry
+}
+
+// Pool limits the connection pool. Zero values leave database/sql's
+// defaults in place.
+type Pool struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// Retry controls how New waits for postgres to come up
+type Retry struct {
+	// Timeout is how long to keep retrying, 0 means only try once
+	Timeout time.Duration
+	// InitialDelay is the wait after the first failure. It doubles after
+	// each one, up to MaxDelay, and is jittered so replicas starting
+	// together don't retry in lockstep.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// New initializes a new database connection. Transient failures to reach
+// postgres are retried according to opts.Retry, or until ctx is done.
+func New(ctx context.Context, opts Options) (*Conn, error) {
+	dsn, err := opts.dsn()
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to db: %v", err)
 	}
+	c := &connector{dsn: dsn}
+	c.password.Store(opts.Password)
+	c.setQueryTimeout(opts.QueryTimeout)
 
-	err = conn.Ping()
-	if err != nil {
+	// Check the DSN up front, Connect only runs once the pool needs a
+	// connection
+	if _, err := c.pqConnector(); err != nil {
+		return nil, fmt.Errorf("error connecting to db: %v", err)
+	}
+	conn := &Conn{
+		conn:      sql.OpenDB(c),
+		connector: c,
+	}
+	conn.SetPool(opts.Pool)
+	if conn.migrator, err = migrate.New(conn.conn); err != nil {
+		conn.conn.Close()
+		return nil, fmt.Errorf("error loading migrations: %v", err)
+	}
+
+	if err := conn.ping(ctx, opts.Retry); err != nil {
+		conn.conn.Close()
 		return nil, fmt.Errorf("error pinging db: %v", err)
 	}
 
-	return &Conn{
-		conn: conn,
-	}, nil
+	return conn, nil
+}
+
+// ping pings postgres until it answers, retrying transient failures with
+// exponential backoff
+func (c *Conn) ping(ctx context.Context, retry Retry) error {
+	deadline := time.Now().Add(retry.Timeout)
+	delay := retry.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := c.conn.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if retry.Timeout <= 0 || !transient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		// Full jitter, anywhere between no wait and the current delay
+		wait := time.Duration(mrand.Int63n(int64(delay) + 1))
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("gave up after %d attempts: %v", attempt, err)
+		}
+		requestid.Logger(ctx).Warnf("db unavailable, retrying in %s: %v", wait.Round(time.Millisecond), err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+		if delay > retry.MaxDelay {
+			delay = retry.MaxDelay
+		}
+	}
+}
+
+// dsn builds a key=value connection string from everything but the password
+// and query timeout, which can change at runtime
+func (o Options) dsn() (string, error) {
+	dsn := o.DSN
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		// The parse error quotes the whole URL, password included
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", errors.New("invalid db url")
+		}
+	}
+
+	sslMode := o.SSLMode
+	if sslMode == "" && o.DSN == "" {
+		sslMode = "disable"
+	}
+
+	// pq takes the last value for a repeated key, so these override the DSN
+	for _, kv := range []struct{ key, value string }{
+		{"host", o.Host},
+		{"user", o.User},
+		{"dbname", o.Database},
+		{"sslmode", sslMode},
+		{"sslrootcert", o.SSLRootCert},
+		{"sslcert", o.SSLCert},
+		{"sslkey", o.SSLKey},
+	} {
+		if kv.value != "" {
+			dsn += fmt.Sprintf(" %s=%s", kv.key, dsnValue(kv.value))
+		}
+	}
+	if o.Port != 0 {
+		dsn += fmt.Sprintf(" port=%d", o.Port)
+	}
+	return strings.TrimSpace(dsn), nil
+}
+
+// SetPool changes the connection pool limits. It's safe to call while the
+// pool is in use.
+func (c *Conn) SetPool(p Pool) {
+	// database/sql keeps 2 idle connections by default, but 0 would mean
+	// none
+	maxIdle := p.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle = 2
+	}
+	c.conn.SetMaxOpenConns(p.MaxOpenConns)
+	c.conn.SetMaxIdleConns(maxIdle)
+	c.conn.SetConnMaxLifetime(p.ConnMaxLifetime)
+	c.conn.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+}
+
+// SetPassword changes the password used for new connections, so a rotated
+// password is picked up without reopening the pool. Open connections stay
+// authenticated with the old one.
+func (c *Conn) SetPassword(password string) {
+	c.connector.password.Store(password)
+}
+
+// SetQueryTimeout changes the limit on every query from now on. Open
+// connections keep their old statement_timeout until they're replaced, but
+// the new limit still applies to their queries through the context.
+func (c *Conn) SetQueryTimeout(queryTimeout time.Duration) {
+	c.connector.setQueryTimeout(queryTimeout)
+}
+
+// connector opens postgres connections with the current password and query
+// timeout
+type connector struct {
+	// queryTimeout bounds every query, 0 means no limit. It's first to keep
+	// it 64-bit aligned for atomic access.
+	queryTimeout int64
+	// dsn is every connection setting that can't change at runtime
+	dsn      string
+	password atomic.Value
+}
+
+func (c *connector) setQueryTimeout(queryTimeout time.Duration) {
+	atomic.StoreInt64(&c.queryTimeout, int64(queryTimeout))
+}
+
+func (c *connector) getQueryTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.queryTimeout))
+}
+
+// pqConnector builds a pq connector for the current settings
+func (c *connector) pqConnector() (*pq.Connector, error) {
+	dsn := c.dsn
+	if password := c.password.Load().(string); password != "" {
+		dsn += fmt.Sprintf(" password=%s", dsnValue(password))
+	}
+	if queryTimeout := c.getQueryTimeout(); queryTimeout > 0 {
+		// Have the server give up too, in case we stop waiting but the
+		// query keeps running
+		dsn += fmt.Sprintf(" statement_timeout=%d", queryTimeout.Milliseconds())
+	}
+	return pq.NewConnector(dsn)
+}
+
+// Connect implements driver.Connector
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	pc, err := c.pqConnector()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pc.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return requestConn{conn}, nil
+}
+
+// Driver implements driver.Connector
+func (c *connector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// dsnValue quotes a value for a key=value connection string, so passwords
+// read from files can contain spaces and quotes
+func dsnValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// withTimeout derives a context for a single query, bounded by the
+// configured query timeout
+func (c *Conn) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	queryTimeout := c.connector.getQueryTimeout()
+	if queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, queryTimeout)
+}
+
+// Ping checks that the database is reachable
+func (c *Conn) Ping(ctx context.Context) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	if err := c.conn.PingContext(ctx); err != nil {
+		return queryError(ctx, "pinging db", err)
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the latest applied migration
+func (c *Conn) SchemaVersion(ctx context.Context) (int, error) {
+	return c.migrator.Version(ctx)
+}
+
+// Close closes every connection in the pool
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// DB returns the underlying connection pool, for tools such as schema
+// migrations that need to manage connections themselves
+func (c *Conn) DB() *sql.DB {
+	return c.conn
+}
+
+// NewID generates a random (version 4) UUID for use as a primary key
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating id: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
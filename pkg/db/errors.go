@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/requestid"
+)
+
+// Kind classifies a store error so callers can react to a category of
+// failure, such as a missing record, without knowing every specific error
+type Kind int
+
+const (
+	// KindInternal is any error that isn't the caller's fault
+	KindInternal Kind = iota
+	// KindNotFound means the record doesn't exist, or isn't visible to the
+	// caller
+	KindNotFound
+	// KindConflict means the change clashes with existing data
+	KindConflict
+	// KindForbidden means the caller may not perform the operation
+	KindForbidden
+	// KindInvalidInput means the arguments were rejected
+	KindInvalidInput
+)
+
+// Error is a store error of a known kind. Its message is safe to show to
+// clients.
+type Error struct {
+	Kind    Kind
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// KindOf returns the kind of a store error, or KindInternal for errors that
+// aren't an *Error
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// InvalidInput returns a KindInvalidInput error with a formatted message
+func InvalidInput(format string, args ...interface{}) error {
+	return &Error{Kind: KindInvalidInput, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	// ErrTimeout is returned when a query runs past its deadline, either the
+	// per-query timeout or the caller's
+	ErrTimeout = errors.New("database query timed out")
+	// ErrCanceled is returned when the caller gives up on a query, usually
+	// because the client disconnected
+	ErrCanceled = errors.New("database query canceled")
+	// ErrUnavailable is returned when the database can't be reached or is
+	// refusing connections for now, e.g. while it restarts. Retrying later
+	// may well succeed.
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+const (
+	// pqQueryCanceled is the postgres error code for a statement canceled
+	// by statement_timeout or a cancel request
+	pqQueryCanceled = "57014"
+	// pqConnectionException is the class of postgres error codes for lost
+	// or refused connections
+	pqConnectionException = "08"
+)
+
+// pqTransient are the postgres error codes, outside the connection
+// exception class, that mean the server is going away or not ready yet
+var pqTransient = map[pq.ErrorCode]bool{
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+	"53300": true, // too_many_connections
+}
+
+// transient reports whether err is a failure to reach postgres that's
+// likely to clear up by itself. database/sql already retries a query once
+// on a fresh connection when a pooled one turns out to be dead, so a
+// transient error during a request means reconnecting failed too.
+func transient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == pqConnectionException || pqTransient[pqErr.Code]
+	}
+
+	// Refused connections, DNS failures and the like
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// ContextError maps a finished context to ErrTimeout or ErrCanceled, and
+// returns nil while ctx is still live
+func ContextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	case context.Canceled:
+		return ErrCanceled
+	}
+	return nil
+}
+
+// queryError annotates an error from a query. If the query failed because
+// its context finished or postgres canceled it, the result wraps ErrTimeout
+// or ErrCanceled, and if postgres couldn't be reached it wraps
+// ErrUnavailable, so callers can tell a slow or restarting database from a
+// broken one. The request ID carried by ctx, if any, is included so the
+// error can be tied to its request wherever it ends up logged.
+func queryError(ctx context.Context, action string, err error) error {
+	if id := requestid.FromContext(ctx); id != "" {
+		action = fmt.Sprintf("%s (request %s)", action, id)
+	}
+
+	if ctxErr := ContextError(ctx); ctxErr != nil {
+		return fmt.Errorf("error %s: %w: %v", action, ctxErr, err)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqQueryCanceled {
+		return fmt.Errorf("error %s: %w: %v", action, ErrTimeout, err)
+	}
+
+	if transient(err) {
+		return fmt.Errorf("error %s: %w: %v", action, ErrUnavailable, err)
+	}
+
+	return fmt.Errorf("error %s: %v", action, err)
+}
@@ -0,0 +1,1217 @@
+// Package memory implements db.Store in memory. It has the same semantics
+// as the Postgres implementation in pkg/db, which makes it suitable for tests
+// and local development, but nothing survives a restart. Operations never
+// block, so contexts are only checked on entry.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+	"github.com/voyagerstudio/haiku-auth/pkg/db"
+	"github.com/voyagerstudio/haiku-auth/pkg/db/migrate"
+)
+
+type user struct {
+	id           string
+	username     string
+	passwordHash string
+	createdAt    time.Time
+}
+
+type note struct {
+	id         string
+	ownerID    string
+	text       string
+	order      int
+	createdAt  time.Time
+	updatedAt  time.Time
+	notebookID string
+	tagIDs     map[string]bool
+	revisions  []*db.Revision
+}
+
+type tag struct {
+	id        string
+	ownerID   string
+	name      string
+	createdAt time.Time
+}
+
+type notebook struct {
+	id        string
+	ownerID   string
+	name      string
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+type refreshToken struct {
+	id         string
+	familyID   string
+	userID     string
+	expiresAt  time.Time
+	used       bool
+	revoked    bool
+	replacedBy string
+}
+
+// Store is an in-memory db.Store
+type Store struct {
+	mu sync.Mutex
+
+	users     map[string]*user
+	usernames map[string]string
+	notes     map[string]*note
+	tags      map[string]*tag
+	notebooks map[string]*notebook
+	tokens    map[string]*refreshToken // by token hash
+}
+
+var _ db.Store = (*Store)(nil)
+
+// New creates an empty Store
+func New() *Store {
+	return &Store{
+		users:     map[string]*user{},
+		usernames: map[string]string{},
+		notes:     map[string]*note{},
+		tags:      map[string]*tag{},
+		notebooks: map[string]*notebook{},
+		tokens:    map[string]*refreshToken{},
+	}
+}
+
+// Ping always succeeds, memory is always reachable
+func (s *Store) Ping(ctx context.Context) error {
+	return nil
+}
+
+// SchemaVersion returns the latest migration version. There's no schema to
+// migrate, so the store is always up to date.
+func (s *Store) SchemaVersion(ctx context.Context) (int, error) {
+	return migrate.Latest(), nil
+}
+
+// CreateUser registers a new user, storing a salted hash of their password
+func (s *Store) CreateUser(ctx context.Context, username, password string) (*db.User, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if username == "" {
+		return nil, db.InvalidInput("username is empty")
+	}
+	if password == "" {
+		return nil, db.InvalidInput("password is empty")
+	}
+
+	// Hash before taking the lock, it's deliberately slow
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing password: %v", err)
+	}
+
+	id, err := db.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.usernames[username]; ok {
+		return nil, db.ErrUserExists
+	}
+
+	u := &user{
+		id:           id,
+		username:     username,
+		passwordHash: hash,
+		createdAt:    time.Now(),
+	}
+	s.users[id] = u
+	s.usernames[username] = id
+
+	return u.toUser(), nil
+}
+
+// VerifyUser checks a username and password, returning the matching user.
+// Unknown usernames and wrong passwords both return db.ErrInvalidCredentials.
+func (s *Store) VerifyUser(ctx context.Context, username, password string) (*db.User, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if username == "" || password == "" {
+		return nil, db.ErrInvalidCredentials
+	}
+
+	s.mu.Lock()
+	var u *user
+	if id, ok := s.usernames[username]; ok {
+		copied := *s.users[id]
+		u = &copied
+	}
+	s.mu.Unlock()
+
+	if u == nil {
+		auth.HashPassword(password)
+		return nil, db.ErrInvalidCredentials
+	}
+
+	if err := auth.ComparePassword(u.passwordHash, password); err != nil {
+		if errors.Is(err, auth.ErrMismatchedPassword) {
+			return nil, db.ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("error comparing password: %v", err)
+	}
+
+	return u.toUser(), nil
+}
+
+// GetNoteList returns a page of a user's notes
+func (s *Store) GetNoteList(ctx context.Context, user string, opts db.NoteListOptions) (*db.NoteList, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	after, err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notes := []*db.Note{}
+	for _, n := range s.ownedNotes(user) {
+		if n.updatedAt.Before(opts.UpdatedSince) {
+			continue
+		}
+		if opts.Notebook != "" && n.notebookID != opts.Notebook {
+			continue
+		}
+		note := s.toNote(n)
+		if !hasTags(note, opts.Tags) {
+			continue
+		}
+		if after != nil && !opts.Less(after, note) {
+			continue
+		}
+		notes = append(notes, note)
+	}
+	sort.Slice(notes, func(i, j int) bool {
+		return opts.Less(notes[i], notes[j])
+	})
+	if len(notes) > opts.Limit+1 {
+		notes = notes[:opts.Limit+1]
+	}
+
+	return db.NewNoteList(notes, opts), nil
+}
+
+// GetNote returns a detailed note for a given note ID, provided it belongs
+// to the given user
+func (s *Store) GetNote(ctx context.Context, user string, note string) (*db.Note, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, db.InvalidInput("note is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[note]
+	if !ok || n.ownerID != user {
+		return nil, db.ErrNoteNotFound
+	}
+
+	return s.toNote(n), nil
+}
+
+// CreateNote creates a new note for the given user at the end of their list
+func (s *Store) CreateNote(ctx context.Context, user string, newNote db.NewNote) (*db.Note, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	tags, err := db.CleanTagNames(newNote.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := db.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user]; !ok {
+		return nil, db.ErrUserNotFound
+	}
+	if newNote.Notebook != "" {
+		if b, ok := s.notebooks[newNote.Notebook]; !ok || b.ownerID != user {
+			return nil, db.ErrNotebookNotFound
+		}
+	}
+
+	// Like COALESCE(MAX(sort_order), 0), which may well be negative once
+	// notes have been moved
+	order, seen := 0, false
+	for _, n := range s.notes {
+		if n.ownerID == user && (!seen || n.order > order) {
+			order, seen = n.order, true
+		}
+	}
+
+	now := time.Now()
+	n := &note{
+		id:         id,
+		ownerID:    user,
+		text:       newNote.Text,
+		order:      order + db.NoteRankGap,
+		createdAt:  now,
+		updatedAt:  now,
+		notebookID: newNote.Notebook,
+	}
+	if n.tagIDs, err = s.tagIDs(user, tags); err != nil {
+		return nil, err
+	}
+	n.addRevision(newNote.Text, 0)
+	s.notes[id] = n
+
+	return s.toNote(n), nil
+}
+
+// UpdateNote applies an update to a note owned by the given user and returns
+// the updated note
+func (s *Store) UpdateNote(ctx context.Context, user string, note string, update db.NoteUpdate) (*db.Note, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, db.InvalidInput("note is empty")
+	}
+	var tags []string
+	if update.Tags != nil {
+		var err error
+		if tags, err = db.CleanTagNames(*update.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[note]
+	if !ok || n.ownerID != user {
+		return nil, db.ErrNoteNotFound
+	}
+	if update.Notebook != nil && *update.Notebook != "" {
+		if b, ok := s.notebooks[*update.Notebook]; !ok || b.ownerID != user {
+			return nil, db.ErrNotebookNotFound
+		}
+	}
+	// Check everything that can fail before changing anything
+	if update.Order != nil {
+		for _, other := range s.ownedNotes(user) {
+			if other.id != n.id && other.order == *update.Order {
+				return nil, db.ErrNoteOrderTaken
+			}
+		}
+	}
+	if update.Tags != nil {
+		tagIDs, err := s.tagIDs(user, tags)
+		if err != nil {
+			return nil, err
+		}
+		n.tagIDs = tagIDs
+	}
+
+	if update.Notebook != nil {
+		n.notebookID = *update.Notebook
+	}
+	if update.Text != nil {
+		n.text = *update.Text
+		n.addRevision(n.text, 0)
+	}
+	if update.Order != nil {
+		n.order = *update.Order
+	}
+	n.updatedAt = time.Now()
+
+	return s.toNote(n), nil
+}
+
+// DeleteNote deletes a note owned by the given user
+func (s *Store) DeleteNote(ctx context.Context, user string, note string) error {
+	if err := db.ContextError(ctx); err != nil {
+		return err
+	}
+
+	if user == "" {
+		return db.InvalidInput("user is empty")
+	}
+	if note == "" {
+		return db.InvalidInput("note is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[note]
+	if !ok || n.ownerID != user {
+		return db.ErrNoteNotFound
+	}
+	delete(s.notes, note)
+
+	return nil
+}
+
+// MoveNote moves a note owned by the given user directly before or after
+// another of their notes, and returns the moved note
+func (s *Store) MoveNote(ctx context.Context, user string, note string, move db.NoteMove) (*db.Note, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, db.InvalidInput("note is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes, err := db.MoveRanks(s.noteRanks(user), note, move)
+	if err != nil {
+		return nil, err
+	}
+	s.setNoteRanks(changes)
+
+	return s.toNote(s.notes[note]), nil
+}
+
+// ReorderNotes puts all of a user's notes in the given order. It fails with
+// a conflict if notes doesn't list exactly the notes the user has.
+func (s *Store) ReorderNotes(ctx context.Context, user string, notes []string) error {
+	if err := db.ContextError(ctx); err != nil {
+		return err
+	}
+
+	if user == "" {
+		return db.InvalidInput("user is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes, err := db.OrderRanks(s.noteRanks(user), notes)
+	if err != nil {
+		return err
+	}
+	s.setNoteRanks(changes)
+
+	return nil
+}
+
+// SearchNotes returns the user's notes matching a query, see
+// db.ParseSearch, best match first. Words are compared after trimming common
+// English endings, a rough stand-in for Postgres's stemming.
+func (s *Store) SearchNotes(ctx context.Context, user string, q string, limit int) (*db.SearchResults, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	terms, err := db.ParseSearch(q)
+	if err != nil {
+		return nil, err
+	}
+	if limit, err = db.SearchLimit(limit); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := []*db.SearchResult{}
+	for _, n := range s.ownedNotes(user) {
+		tokens := db.SearchTokens(n.text)
+		hits, ok := matchTerms(tokens, terms)
+		if !ok {
+			continue
+		}
+		results = append(results, &db.SearchResult{
+			Note:    s.toNote(n),
+			Rank:    float64(len(hits)) / float64(len(tokens)),
+			Snippet: snippet(n.text, tokens, hits),
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Note.ID < results[j].Note.ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return &db.SearchResults{Results: results}, nil
+}
+
+// GetTags returns a user's tags with the number of notes carrying each
+func (s *Store) GetTags(ctx context.Context, user string) (*db.TagList, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tags := []*db.Tag{}
+	for _, t := range s.tags {
+		if t.ownerID == user {
+			tags = append(tags, s.toTag(t))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+
+	return &db.TagList{Tags: tags}, nil
+}
+
+// CreateTag creates a tag for the given user
+func (s *Store) CreateTag(ctx context.Context, user string, name string) (*db.Tag, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	name, err := db.CleanName("tag", name)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := db.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user]; !ok {
+		return nil, db.ErrUserNotFound
+	}
+	if s.tagNamed(user, name) != nil {
+		return nil, db.ErrTagExists
+	}
+
+	t := &tag{id: id, ownerID: user, name: name, createdAt: time.Now()}
+	s.tags[id] = t
+
+	return s.toTag(t), nil
+}
+
+// RenameTag renames a tag owned by the given user, which renames it on every
+// note carrying it
+func (s *Store) RenameTag(ctx context.Context, user string, tag string, name string) (*db.Tag, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if tag == "" {
+		return nil, db.InvalidInput("tag is empty")
+	}
+	name, err := db.CleanName("tag", name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tags[tag]
+	if !ok || t.ownerID != user {
+		return nil, db.ErrTagNotFound
+	}
+	if other := s.tagNamed(user, name); other != nil && other != t {
+		return nil, db.ErrTagExists
+	}
+	t.name = name
+
+	return s.toTag(t), nil
+}
+
+// DeleteTag deletes a tag owned by the given user, taking it off every note
+func (s *Store) DeleteTag(ctx context.Context, user string, tag string) error {
+	if err := db.ContextError(ctx); err != nil {
+		return err
+	}
+
+	if user == "" {
+		return db.InvalidInput("user is empty")
+	}
+	if tag == "" {
+		return db.InvalidInput("tag is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tags[tag]
+	if !ok || t.ownerID != user {
+		return db.ErrTagNotFound
+	}
+	for _, n := range s.ownedNotes(user) {
+		delete(n.tagIDs, tag)
+	}
+	delete(s.tags, tag)
+
+	return nil
+}
+
+// GetNotebooks returns a user's notebooks with the number of notes in each
+func (s *Store) GetNotebooks(ctx context.Context, user string) (*db.NotebookList, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notebooks := []*db.Notebook{}
+	for _, b := range s.notebooks {
+		if b.ownerID == user {
+			notebooks = append(notebooks, s.toNotebook(b))
+		}
+	}
+	sort.Slice(notebooks, func(i, j int) bool {
+		return notebooks[i].Name < notebooks[j].Name
+	})
+
+	return &db.NotebookList{Notebooks: notebooks}, nil
+}
+
+// GetNotebook returns a notebook owned by the given user
+func (s *Store) GetNotebook(ctx context.Context, user string, notebook string) (*db.Notebook, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if notebook == "" {
+		return nil, db.InvalidInput("notebook is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.notebooks[notebook]
+	if !ok || b.ownerID != user {
+		return nil, db.ErrNotebookNotFound
+	}
+
+	return s.toNotebook(b), nil
+}
+
+// CreateNotebook creates an empty notebook for the given user
+func (s *Store) CreateNotebook(ctx context.Context, user string, name string) (*db.Notebook, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	name, err := db.CleanName("notebook", name)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := db.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user]; !ok {
+		return nil, db.ErrUserNotFound
+	}
+	if s.notebookNamed(user, name) != nil {
+		return nil, db.ErrNotebookExists
+	}
+
+	now := time.Now()
+	b := &notebook{id: id, ownerID: user, name: name, createdAt: now, updatedAt: now}
+	s.notebooks[id] = b
+
+	return s.toNotebook(b), nil
+}
+
+// RenameNotebook renames a notebook owned by the given user
+func (s *Store) RenameNotebook(ctx context.Context, user string, notebook string, name string) (*db.Notebook, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if notebook == "" {
+		return nil, db.InvalidInput("notebook is empty")
+	}
+	name, err := db.CleanName("notebook", name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.notebooks[notebook]
+	if !ok || b.ownerID != user {
+		return nil, db.ErrNotebookNotFound
+	}
+	if other := s.notebookNamed(user, name); other != nil && other != b {
+		return nil, db.ErrNotebookExists
+	}
+	b.name = name
+	b.updatedAt = time.Now()
+
+	return s.toNotebook(b), nil
+}
+
+// DeleteNotebook deletes a notebook owned by the given user. Its notes are
+// kept, outside any notebook.
+func (s *Store) DeleteNotebook(ctx context.Context, user string, notebook string) error {
+	if err := db.ContextError(ctx); err != nil {
+		return err
+	}
+
+	if user == "" {
+		return db.InvalidInput("user is empty")
+	}
+	if notebook == "" {
+		return db.InvalidInput("notebook is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.notebooks[notebook]
+	if !ok || b.ownerID != user {
+		return db.ErrNotebookNotFound
+	}
+	for _, n := range s.ownedNotes(user) {
+		if n.notebookID == notebook {
+			n.notebookID = ""
+		}
+	}
+	delete(s.notebooks, notebook)
+
+	return nil
+}
+
+// GetRevisions returns every revision of a note owned by the given user
+func (s *Store) GetRevisions(ctx context.Context, user string, note string) (*db.RevisionList, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, db.InvalidInput("note is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[note]
+	if !ok || n.ownerID != user {
+		return nil, db.ErrNoteNotFound
+	}
+
+	revisions := make([]*db.Revision, 0, len(n.revisions))
+	for i := len(n.revisions) - 1; i >= 0; i-- {
+		r := *n.revisions[i]
+		revisions = append(revisions, &r)
+	}
+
+	return &db.RevisionList{Revisions: revisions}, nil
+}
+
+// GetRevision returns one revision of a note owned by the given user
+func (s *Store) GetRevision(ctx context.Context, user string, note string, revision int) (*db.Revision, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, db.InvalidInput("note is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[note]
+	if !ok || n.ownerID != user {
+		return nil, db.ErrNoteNotFound
+	}
+	r, err := n.revision(revision)
+	if err != nil {
+		return nil, err
+	}
+	copied := *r
+
+	return &copied, nil
+}
+
+// RestoreRevision makes an older revision's text the current text of a note
+// owned by the given user, recording it as a new revision. Restoring the
+// current text changes nothing, not even the note's update time.
+func (s *Store) RestoreRevision(ctx context.Context, user string, note string, revision int) (*db.Note, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if user == "" {
+		return nil, db.InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, db.InvalidInput("note is empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[note]
+	if !ok || n.ownerID != user {
+		return nil, db.ErrNoteNotFound
+	}
+	r, err := n.revision(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Text != n.text {
+		n.text = r.Text
+		n.updatedAt = time.Now()
+		n.addRevision(r.Text, revision)
+	}
+
+	return s.toNote(n), nil
+}
+
+// CreateRefreshToken stores a refresh token for a user as the first member
+// of a new token family. Only a hash of the token is kept.
+func (s *Store) CreateRefreshToken(ctx context.Context, user, token string, expiresAt time.Time) error {
+	if err := db.ContextError(ctx); err != nil {
+		return err
+	}
+
+	if user == "" {
+		return db.InvalidInput("user is empty")
+	}
+	if token == "" {
+		return db.InvalidInput("token is empty")
+	}
+
+	id, err := db.NewID()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user]; !ok {
+		return fmt.Errorf("error inserting refresh token: unknown user %s", user)
+	}
+
+	s.tokens[auth.HashRefreshToken(token)] = &refreshToken{
+		id:        id,
+		familyID:  id,
+		userID:    user,
+		expiresAt: expiresAt,
+	}
+
+	return nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// family, returning the user the tokens belong to. Each token may be used
+// once; presenting a used token revokes every token in its family and
+// returns db.ErrRefreshTokenReused.
+func (s *Store) RotateRefreshToken(ctx context.Context, oldToken, newToken string, expiresAt time.Time) (string, error) {
+	if err := db.ContextError(ctx); err != nil {
+		return "", err
+	}
+
+	if oldToken == "" {
+		return "", db.ErrInvalidRefreshToken
+	}
+	if newToken == "" {
+		return "", errors.New("new token is empty")
+	}
+
+	nextID, err := db.NewID()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[auth.HashRefreshToken(oldToken)]
+	if !ok || t.revoked {
+		return "", db.ErrInvalidRefreshToken
+	}
+
+	if t.used {
+		for _, other := range s.tokens {
+			if other.familyID == t.familyID {
+				other.revoked = true
+			}
+		}
+		return "", db.ErrRefreshTokenReused
+	}
+
+	if time.Now().After(t.expiresAt) {
+		return "", db.ErrInvalidRefreshToken
+	}
+
+	t.used = true
+	t.replacedBy = nextID
+	s.tokens[auth.HashRefreshToken(newToken)] = &refreshToken{
+		id:        nextID,
+		familyID:  t.familyID,
+		userID:    t.userID,
+		expiresAt: expiresAt,
+	}
+
+	return t.userID, nil
+}
+
+// ownedNotes returns a user's notes by sort order. The caller must hold s.mu.
+func (s *Store) ownedNotes(user string) []*note {
+	owned := []*note{}
+	for _, n := range s.notes {
+		if n.ownerID == user {
+			owned = append(owned, n)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		if owned[i].order != owned[j].order {
+			return owned[i].order < owned[j].order
+		}
+		return owned[i].id < owned[j].id
+	})
+	return owned
+}
+
+// noteRanks returns a user's notes' places in sort order. The caller must
+// hold s.mu.
+func (s *Store) noteRanks(user string) []db.NoteRank {
+	owned := s.ownedNotes(user)
+	ranks := make([]db.NoteRank, 0, len(owned))
+	for _, n := range owned {
+		ranks = append(ranks, db.NoteRank{ID: n.id, Order: n.order})
+	}
+	return ranks
+}
+
+// setNoteRanks applies new sort orders, marking the notes updated. The
+// caller must hold s.mu.
+func (s *Store) setNoteRanks(changes map[string]int) {
+	now := time.Now()
+	for id, order := range changes {
+		s.notes[id].order = order
+		s.notes[id].updatedAt = now
+	}
+}
+
+// tagIDs returns the IDs of a user's tags by name, creating the ones they
+// don't have yet. The caller must hold s.mu.
+func (s *Store) tagIDs(user string, names []string) (map[string]bool, error) {
+	ids := make(map[string]bool, len(names))
+	for _, name := range names {
+		t := s.tagNamed(user, name)
+		if t == nil {
+			id, err := db.NewID()
+			if err != nil {
+				return nil, err
+			}
+			t = &tag{id: id, ownerID: user, name: name, createdAt: time.Now()}
+			s.tags[id] = t
+		}
+		ids[t.id] = true
+	}
+	return ids, nil
+}
+
+// tagNamed returns a user's tag by name, or nil. The caller must hold s.mu.
+func (s *Store) tagNamed(user string, name string) *tag {
+	for _, t := range s.tags {
+		if t.ownerID == user && t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// notebookNamed returns a user's notebook by name, or nil. The caller must
+// hold s.mu.
+func (s *Store) notebookNamed(user string, name string) *notebook {
+	for _, b := range s.notebooks {
+		if b.ownerID == user && b.name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// addRevision records text as the note's next revision, unless it's the
+// same as the latest one. restoredFrom is the revision it restores, or 0.
+func (n *note) addRevision(text string, restoredFrom int) {
+	if len(n.revisions) > 0 && n.revisions[len(n.revisions)-1].Text == text {
+		return
+	}
+	n.revisions = append(n.revisions, &db.Revision{
+		Revision:     len(n.revisions) + 1,
+		Text:         text,
+		CreatedAt:    time.Now(),
+		RestoredFrom: restoredFrom,
+	})
+}
+
+// revision returns one of the note's revisions
+func (n *note) revision(revision int) (*db.Revision, error) {
+	if revision < 1 || revision > len(n.revisions) {
+		return nil, db.ErrRevisionNotFound
+	}
+	return n.revisions[revision-1], nil
+}
+
+// hasTags reports whether a note has every one of the named tags
+func hasTags(n *db.Note, names []string) bool {
+	for _, name := range names {
+		i := sort.SearchStrings(n.Tags, name)
+		if i == len(n.Tags) || n.Tags[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *user) toUser() *db.User {
+	return &db.User{
+		ID:        u.id,
+		Username:  u.username,
+		CreatedAt: u.createdAt,
+	}
+}
+
+// toNote converts a note, looking up its tags' names. The caller must hold
+// s.mu.
+func (s *Store) toNote(n *note) *db.Note {
+	tags := make([]string, 0, len(n.tagIDs))
+	for id := range n.tagIDs {
+		tags = append(tags, s.tags[id].name)
+	}
+	sort.Strings(tags)
+	return &db.Note{
+		ID:        n.id,
+		Text:      n.text,
+		Order:     n.order,
+		CreatedAt: n.createdAt,
+		UpdatedAt: n.updatedAt,
+		Notebook:  n.notebookID,
+		Tags:      tags,
+	}
+}
+
+// toTag converts a tag, counting its notes. The caller must hold s.mu.
+func (s *Store) toTag(t *tag) *db.Tag {
+	count := 0
+	for _, n := range s.ownedNotes(t.ownerID) {
+		if n.tagIDs[t.id] {
+			count++
+		}
+	}
+	return &db.Tag{
+		ID:        t.id,
+		Name:      t.name,
+		CreatedAt: t.createdAt,
+		Notes:     count,
+	}
+}
+
+// toNotebook converts a notebook, counting its notes. The caller must hold
+// s.mu.
+func (s *Store) toNotebook(b *notebook) *db.Notebook {
+	count := 0
+	for _, n := range s.ownedNotes(b.ownerID) {
+		if n.notebookID == b.id {
+			count++
+		}
+	}
+	return &db.Notebook{
+		ID:        b.id,
+		Name:      b.name,
+		CreatedAt: b.createdAt,
+		UpdatedAt: b.updatedAt,
+		Notes:     count,
+	}
+}
+
+// snippetWords is the most words of a note shown in a search snippet
+const snippetWords = 35
+
+// escapeHTML escapes snippets the same way the Postgres store does
+var escapeHTML = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// matchTerms finds every term in tokens, returning the indexes of the
+// matching tokens, or false if any term is missing
+func matchTerms(tokens []db.SearchToken, terms []db.SearchTerm) (map[int]bool, bool) {
+	hits := make(map[int]bool)
+	for _, term := range terms {
+		found := false
+		for i := 0; i+len(term.Words) <= len(tokens); i++ {
+			matched := true
+			for j, word := range term.Words {
+				if !wordMatches(tokens[i+j].Word, word, term.Prefix && j == len(term.Words)-1) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				found = true
+				for j := range term.Words {
+					hits[i+j] = true
+				}
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return hits, true
+}
+
+// wordMatches reports whether a word of a note matches a search word
+func wordMatches(token, word string, prefix bool) bool {
+	if prefix {
+		return strings.HasPrefix(token, word)
+	}
+	return stem(token) == stem(word)
+}
+
+// stem trims the commonest English endings from a lowercase word
+func stem(word string) string {
+	for _, suffix := range []string{"ing", "ed", "es", "s"} {
+		if strings.HasSuffix(word, suffix) && len(word)-len(suffix) >= 3 {
+			return word[:len(word)-len(suffix)]
+		}
+	}
+	return word
+}
+
+// snippet returns up to snippetWords words of text around the first hit, HTML
+// escaped, with the hits highlighted
+func snippet(text string, tokens []db.SearchToken, hits map[int]bool) string {
+	first, last := 0, len(tokens)
+	if len(tokens) > snippetWords {
+		for i := range tokens {
+			if hits[i] {
+				first = i
+				break
+			}
+		}
+		// Show a little of what leads up to the first match
+		first -= snippetWords / 4
+		if first < 0 {
+			first = 0
+		}
+		if first+snippetWords < last {
+			last = first + snippetWords
+		}
+	}
+
+	var b strings.Builder
+	start, end := 0, len(text)
+	if first > 0 {
+		start = tokens[first].Start
+	}
+	if last < len(tokens) {
+		end = tokens[last-1].End
+	}
+	pos := start
+	for i := first; i < last; i++ {
+		if !hits[i] {
+			continue
+		}
+		t := tokens[i]
+		b.WriteString(escapeHTML.Replace(text[pos:t.Start]))
+		b.WriteString(db.HighlightStart)
+		b.WriteString(escapeHTML.Replace(text[t.Start:t.End]))
+		b.WriteString(db.HighlightEnd)
+		pos = t.End
+	}
+	b.WriteString(escapeHTML.Replace(text[pos:end]))
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,335 @@
+// Package migrate applies the versioned SQL migrations that define the
+// haiku-auth schema. Migrations are embedded in the binary as pairs of
+// NNNN_name.up.sql and NNNN_name.down.sql files, and the versions applied to
+// a database are tracked in the schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+// lockKey identifies the advisory lock held while migrating, so replicas
+// starting at the same time apply migrations one at a time
+const lockKey = 0x6861696b75 // "haiku"
+
+// Migration is a single schema change with its rollback
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes whether a migration has been applied to a database
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New creates a Migrator for the embedded migration set
+func New(db *sql.DB) (*Migrator, error) {
+	migrations, err := load(embedded, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}, nil
+}
+
+// Latest returns the version of the newest embedded migration, which is the
+// version a fully migrated database is at
+func Latest() int {
+	migrations, err := load(embedded, "migrations")
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// load reads and validates the migrations in dir. Versions must start at 1
+// and be contiguous, and every version needs both an up and a down file.
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %v", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration file %s is not named NNNN_name.%s.sql", name, direction)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file %s has an invalid version", name)
+		}
+
+		b, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %v", name, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration %d has mismatched names %s and %s", version, m.Name, parts[1])
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("missing migration %d", i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", m.Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if current > len(m.migrations) {
+			log.Warnf("database is at migration %d, newer than the latest known migration %d", current, len(m.migrations))
+		}
+
+		for _, mig := range m.migrations {
+			if mig.Version <= current {
+				continue
+			}
+			log.Infof("applying migration %d_%s", mig.Version, mig.Name)
+			err := m.apply(ctx, conn, mig.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", mig.Version, mig.Name)
+			if err != nil {
+				return fmt.Errorf("error applying migration %d_%s: %v", mig.Version, mig.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the given number of most recently applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if current > len(m.migrations) {
+			return fmt.Errorf("can't roll back migration %d, it is newer than this binary", current)
+		}
+
+		for i := 0; i < steps && current > 0; i++ {
+			mig := m.migrations[current-1]
+			log.Infof("rolling back migration %d_%s", mig.Version, mig.Name)
+			err := m.apply(ctx, conn, mig.Down, "DELETE FROM schema_migrations WHERE version = $1", mig.Version)
+			if err != nil {
+				return fmt.Errorf("error rolling back migration %d_%s: %v", mig.Version, mig.Name, err)
+			}
+			current--
+		}
+		return nil
+	})
+}
+
+// Status reports which migrations have been applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting connection: %v", err)
+	}
+	defer conn.Close()
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		at, ok := applied[mig.Version]
+		statuses = append(statuses, Status{
+			Version:   mig.Version,
+			Name:      mig.Name,
+			Applied:   ok,
+			AppliedAt: at,
+		})
+	}
+	return statuses, nil
+}
+
+// Version returns the version of the most recently applied migration, or 0
+// for an empty database
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting connection: %v", err)
+	}
+	defer conn.Close()
+
+	return m.version(ctx, conn)
+}
+
+// withLock runs fn on a single connection while holding the migration
+// advisory lock. Advisory locks belong to a session, so everything has to
+// happen on the connection that took the lock.
+func (m *Migrator) withLock(ctx context.Context, fn func(*sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting connection: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("error acquiring migration lock: %v", err)
+	}
+	defer func() {
+		// Use a fresh context so the lock is released even if ctx is done
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey); err != nil {
+			log.Errorf("error releasing migration lock: %v", err)
+		}
+	}()
+
+	if err := m.ensureTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// apply runs a migration script and its schema_migrations bookkeeping in a
+// single transaction
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return fmt.Errorf("error recording migration: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer     PRIMARY KEY,
+		name       text        NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %v", err)
+	}
+	return nil
+}
+
+// applied returns when each applied migration was applied. A database that
+// has never been migrated has no schema_migrations table and nothing applied.
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	var exists bool
+	if err := conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("error checking for schema_migrations: %v", err)
+	}
+	if !exists {
+		return map[int]time.Time{}, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error querying for migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("error scanning results: %v", err)
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while parsing rows: %v", err)
+	}
+	return applied, nil
+}
+
+// version returns the current schema version, checking that the applied
+// migrations are exactly 1..version. A database can be ahead of this binary
+// while a newer release is rolled out.
+func (m *Migrator) version(ctx context.Context, conn *sql.Conn) (int, error) {
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	for v := 1; v <= len(applied); v++ {
+		if _, ok := applied[v]; !ok {
+			return 0, fmt.Errorf("database is missing migration %d", v)
+		}
+	}
+	return len(applied), nil
+}
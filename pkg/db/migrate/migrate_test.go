@@ -0,0 +1,35 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := load(embedded, "migrations")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	require.Equal(t, len(migrations), Latest())
+}
+
+func TestLoadRejectsBadSets(t *testing.T) {
+	for name, files := range map[string]fstest.MapFS{
+		"missing down": {
+			"m/0001_a.up.sql": {Data: []byte("SELECT 1")},
+		},
+		"gap": {
+			"m/0001_a.up.sql":   {Data: []byte("SELECT 1")},
+			"m/0001_a.down.sql": {Data: []byte("SELECT 1")},
+			"m/0003_c.up.sql":   {Data: []byte("SELECT 1")},
+			"m/0003_c.down.sql": {Data: []byte("SELECT 1")},
+		},
+		"bad name": {
+			"m/first.up.sql": {Data: []byte("SELECT 1")},
+		},
+	} {
+		_, err := load(files, "m")
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,17 @@
+CREATE TABLE users (
+    id            text        PRIMARY KEY,
+    username      text        NOT NULL UNIQUE,
+    password_hash text        NOT NULL,
+    created_at    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE notes (
+    id         text        PRIMARY KEY,
+    owner_id   text        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    data       text        NOT NULL,
+    sort_order integer     NOT NULL DEFAULT 0,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX notes_owner_id_sort_order_idx ON notes (owner_id, sort_order);
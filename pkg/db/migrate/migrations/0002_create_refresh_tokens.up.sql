@@ -0,0 +1,13 @@
+CREATE TABLE refresh_tokens (
+    id          text        PRIMARY KEY,
+    family_id   text        NOT NULL,
+    user_id     text        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash  text        NOT NULL UNIQUE,
+    created_at  timestamptz NOT NULL DEFAULT now(),
+    expires_at  timestamptz NOT NULL,
+    used_at     timestamptz,
+    revoked_at  timestamptz,
+    replaced_by text
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
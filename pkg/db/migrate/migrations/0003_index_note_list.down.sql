@@ -0,0 +1,2 @@
+DROP INDEX notes_owner_id_updated_at_idx;
+DROP INDEX notes_owner_id_created_at_idx;
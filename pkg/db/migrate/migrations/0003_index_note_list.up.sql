@@ -0,0 +1,3 @@
+-- Keyset pagination of the note list by each of its sort keys
+CREATE INDEX notes_owner_id_created_at_idx ON notes (owner_id, created_at, id);
+CREATE INDEX notes_owner_id_updated_at_idx ON notes (owner_id, updated_at, id);
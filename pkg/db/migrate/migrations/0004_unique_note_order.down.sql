@@ -0,0 +1,2 @@
+CREATE INDEX notes_owner_id_sort_order_idx ON notes (owner_id, sort_order);
+ALTER TABLE notes DROP CONSTRAINT notes_owner_id_sort_order_key;
@@ -0,0 +1,10 @@
+-- Space out existing notes, which may share a sort_order, so reordering has
+-- room to place a note between two others
+UPDATE notes AS n SET sort_order = r.rank * 1024
+FROM (SELECT id, row_number() OVER (PARTITION BY owner_id ORDER BY sort_order, id) AS rank FROM notes) AS r
+WHERE n.id = r.id;
+
+-- Deferred, so renumbering a user's notes in one statement or transaction
+-- doesn't trip over values that are only briefly shared
+ALTER TABLE notes ADD CONSTRAINT notes_owner_id_sort_order_key UNIQUE (owner_id, sort_order) DEFERRABLE INITIALLY DEFERRED;
+DROP INDEX notes_owner_id_sort_order_idx;
@@ -0,0 +1,4 @@
+DROP TABLE note_tags;
+DROP TABLE tags;
+ALTER TABLE notes DROP COLUMN notebook_id;
+DROP TABLE notebooks;
@@ -0,0 +1,28 @@
+CREATE TABLE notebooks (
+    id         text        PRIMARY KEY,
+    owner_id   text        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name       text        NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (owner_id, name)
+);
+
+-- Deleting a notebook keeps its notes, outside any notebook
+ALTER TABLE notes ADD COLUMN notebook_id text REFERENCES notebooks (id) ON DELETE SET NULL;
+CREATE INDEX notes_notebook_id_idx ON notes (notebook_id);
+
+CREATE TABLE tags (
+    id         text        PRIMARY KEY,
+    owner_id   text        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name       text        NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (owner_id, name)
+);
+
+CREATE TABLE note_tags (
+    note_id text NOT NULL REFERENCES notes (id) ON DELETE CASCADE,
+    tag_id  text NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    PRIMARY KEY (note_id, tag_id)
+);
+
+CREATE INDEX note_tags_tag_id_idx ON note_tags (tag_id);
@@ -0,0 +1,2 @@
+DROP TABLE note_revisions;
+DROP FUNCTION note_revisions_immutable();
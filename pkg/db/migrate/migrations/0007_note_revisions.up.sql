@@ -0,0 +1,23 @@
+CREATE TABLE note_revisions (
+    note_id       text        NOT NULL REFERENCES notes (id) ON DELETE CASCADE,
+    revision      integer     NOT NULL,
+    data          text        NOT NULL,
+    created_at    timestamptz NOT NULL DEFAULT now(),
+    -- restored_from is the older revision this one restored, if any
+    restored_from integer,
+    PRIMARY KEY (note_id, revision)
+);
+
+-- Existing notes start their history with their current text
+INSERT INTO note_revisions (note_id, revision, data, created_at)
+SELECT id, 1, data, updated_at FROM notes;
+
+-- Revisions are never changed once written, only deleted with their note
+CREATE FUNCTION note_revisions_immutable() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    RAISE EXCEPTION 'note revisions are immutable';
+END
+$$;
+
+CREATE TRIGGER note_revisions_immutable BEFORE UPDATE ON note_revisions
+    FOR EACH ROW EXECUTE FUNCTION note_revisions_immutable();
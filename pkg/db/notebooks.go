@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotebookNotFound is returned when a notebook doesn't exist or
+	// belongs to a different user
+	ErrNotebookNotFound = &Error{Kind: KindNotFound, Message: "notebook not found"}
+	// ErrNotebookExists is returned when a user already has a notebook by
+	// that name
+	ErrNotebookExists = &Error{Kind: KindConflict, Message: "notebook already exists"}
+)
+
+// Notebook is a collection of notes. A note is in at most one notebook.
+type Notebook struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Notes is the number of notes in the notebook
+	Notes int `json:"notes"`
+}
+
+// NotebookList contains a user's notebooks, by name
+type NotebookList struct {
+	Notebooks []*Notebook `json:"notebooks"`
+}
+
+// notebookColumns are the columns scanned by scanNotebook, with notebooks
+// aliased as b
+const notebookColumns = "b.id, b.name, b.created_at, b.updated_at, (SELECT count(*) FROM notes WHERE notebook_id = b.id)"
+
+// scanNotebook scans a row of notebookColumns
+func scanNotebook(row interface{ Scan(...interface{}) error }) (*Notebook, error) {
+	var b Notebook
+	if err := row.Scan(&b.ID, &b.Name, &b.CreatedAt, &b.UpdatedAt, &b.Notes); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetNotebooks returns a user's notebooks with the number of notes in each
+func (c *Conn) GetNotebooks(ctx context.Context, user string) (*NotebookList, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	res, err := c.conn.QueryContext(ctx, "SELECT "+notebookColumns+" FROM notebooks AS b WHERE b.owner_id = $1 ORDER BY b.name", user)
+	if err != nil {
+		return nil, queryError(ctx, "querying for notebooks", err)
+	}
+	defer res.Close()
+
+	notebooks := []*Notebook{}
+	for res.Next() {
+		b, err := scanNotebook(res)
+		if err != nil {
+			return nil, queryError(ctx, "scanning results", err)
+		}
+		notebooks = append(notebooks, b)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, queryError(ctx, "while parsing rows", err)
+	}
+
+	return &NotebookList{Notebooks: notebooks}, nil
+}
+
+// GetNotebook returns a notebook owned by the given user
+func (c *Conn) GetNotebook(ctx context.Context, user string, notebook string) (*Notebook, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if notebook == "" {
+		return nil, InvalidInput("notebook is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	b, err := scanNotebook(c.conn.QueryRowContext(ctx, "SELECT "+notebookColumns+" FROM notebooks AS b WHERE b.id = $1 AND b.owner_id = $2", notebook, user))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotebookNotFound
+	}
+	if err != nil {
+		return nil, queryError(ctx, "scanning results", err)
+	}
+
+	return b, nil
+}
+
+// CreateNotebook creates an empty notebook for the given user
+func (c *Conn) CreateNotebook(ctx context.Context, user string, name string) (*Notebook, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	name, err := CleanName("notebook", name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	b := Notebook{ID: id, Name: name}
+	err = c.conn.QueryRowContext(ctx, "INSERT INTO notebooks (id, owner_id, name) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
+		id, user, name).Scan(&b.CreatedAt, &b.UpdatedAt)
+	if isUniqueViolation(err) {
+		return nil, ErrNotebookExists
+	}
+	// The owner is the only row a notebook references
+	if isForeignKeyViolation(err) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, queryError(ctx, "inserting notebook", err)
+	}
+
+	return &b, nil
+}
+
+// RenameNotebook renames a notebook owned by the given user
+func (c *Conn) RenameNotebook(ctx context.Context, user string, notebook string, name string) (*Notebook, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if notebook == "" {
+		return nil, InvalidInput("notebook is empty")
+	}
+	name, err := CleanName("notebook", name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	b, err := scanNotebook(c.conn.QueryRowContext(ctx, `UPDATE notebooks AS b SET name = $3, updated_at = now()
+		WHERE b.id = $1 AND b.owner_id = $2
+		RETURNING `+notebookColumns, notebook, user, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotebookNotFound
+	}
+	if isUniqueViolation(err) {
+		return nil, ErrNotebookExists
+	}
+	if err != nil {
+		return nil, queryError(ctx, "updating notebook", err)
+	}
+
+	return b, nil
+}
+
+// DeleteNotebook deletes a notebook owned by the given user. Its notes are
+// kept, outside any notebook.
+func (c *Conn) DeleteNotebook(ctx context.Context, user string, notebook string) error {
+	if user == "" {
+		return InvalidInput("user is empty")
+	}
+	if notebook == "" {
+		return InvalidInput("notebook is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	res, err := c.conn.ExecContext(ctx, "DELETE FROM notebooks WHERE id = $1 AND owner_id = $2", notebook, user)
+	if err != nil {
+		return queryError(ctx, "deleting notebook", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return queryError(ctx, "reading deleted rows", err)
+	}
+	if n == 0 {
+		return ErrNotebookNotFound
+	}
+
+	return nil
+}
+
+// checkNotebook makes sure a notebook exists and belongs to the user, and
+// keeps it from being deleted until tx ends
+func checkNotebook(ctx context.Context, tx *sql.Tx, user string, notebook string) error {
+	var id string
+	err := tx.QueryRowContext(ctx, "SELECT id FROM notebooks WHERE id = $1 AND owner_id = $2 FOR KEY SHARE", notebook, user).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotebookNotFound
+	}
+	if err != nil {
+		return queryError(ctx, "querying for notebook", err)
+	}
+	return nil
+}
@@ -1,14 +1,65 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrNoteNotFound is returned when a note doesn't exist or belongs to a
+// different user. The two cases are deliberately indistinguishable.
+var ErrNoteNotFound = &Error{Kind: KindNotFound, Message: "note not found"}
+
+const (
+	// DefaultNoteListLimit is the page size when none is asked for
+	DefaultNoteListLimit = 50
+	// MaxNoteListLimit is the largest page of notes returned at once
+	MaxNoteListLimit = 200
 )
 
-// NoteList contains a list of note IDs
+// NoteList contains a page of note IDs, along with the full notes if they
+// were asked for
 type NoteList struct {
-	Notes []string `json:"notes"`
+	Notes     []string `json:"notes"`
+	Summaries []*Note  `json:"summaries,omitempty"`
+	// NextCursor fetches the next page, it's empty on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// NoteSort is a field the note list can be sorted by
+type NoteSort string
+
+const (
+	SortOrder     NoteSort = "order"
+	SortCreatedAt NoteSort = "created_at"
+	SortUpdatedAt NoteSort = "updated_at"
+)
+
+// NoteListOptions pages, sorts and filters a note list. The zero value
+// returns the first page in sort order.
+type NoteListOptions struct {
+	Sort NoteSort
+	Desc bool
+	// Limit is the page size, DefaultNoteListLimit if 0
+	Limit int
+	// Cursor continues from a previous page's NextCursor, and must be used
+	// with the same sort
+	Cursor string
+	// UpdatedSince, if set, leaves out notes last updated before it
+	UpdatedSince time.Time
+	// Full adds the notes themselves to the list, not just their IDs
+	Full bool
+	// Tags, if set, limits the list to notes with every one of the named
+	// tags, and Notebook to the notes in a notebook
+	Tags     []string
+	Notebook string
 }
 
 // Note contains all details needed to dispaly a note
@@ -18,58 +69,562 @@ type Note struct {
 	Order     int       `json:"order"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// Notebook is the ID of the notebook the note is in, if any
+	Notebook string `json:"notebook,omitempty"`
+	// Tags are the names of the note's tags, sorted
+	Tags []string `json:"tags"`
+}
+
+// NewNote holds the fields of a note to create
+type NewNote struct {
+	Text     string
+	Notebook string
+	// Tags are tag names, tags the user doesn't have yet are created
+	Tags []string
+}
+
+// NoteUpdate holds the fields to change on a note. Nil fields are left as is.
+type NoteUpdate struct {
+	Text  *string
+	Order *int
+	// Notebook moves the note to another notebook, or out of its notebook
+	// if it's empty
+	Notebook *string
+	// Tags replaces the note's tags, see NewNote
+	Tags *[]string
 }
 
-// GetNoteList return a list of note IDs for a given user ID
-func (c *Conn) GetNoteList(user string) (*NoteList, error) {
+// noteColumns are the columns scanned by scanNote
+const noteColumns = "id, data, sort_order, created_at, updated_at, notebook_id"
+
+// scanNote scans a row of noteColumns. Tags are loaded separately, see
+// loadNoteTags.
+func scanNote(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Note, error) {
+	var n Note
+	var notebook sql.NullString
+	dest := append([]interface{}{&n.ID, &n.Text, &n.Order, &n.CreatedAt, &n.UpdatedAt, &notebook}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	n.Notebook = notebook.String
+	return &n, nil
+}
+
+// GetNoteList returns a page of a user's notes
+func (c *Conn) GetNoteList(ctx context.Context, user string, opts NoteListOptions) (*NoteList, error) {
 	if user == "" {
-		return nil, errors.New("user is empty")
+		return nil, InvalidInput("user is empty")
+	}
+	after, err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	column, dir, cmp := noteSortColumns[opts.Sort], "ASC", ">"
+	if opts.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	query := "SELECT " + noteColumns + " FROM notes WHERE owner_id = $1"
+	args := []interface{}{user}
+	if opts.Notebook != "" {
+		args = append(args, opts.Notebook)
+		query += fmt.Sprintf(" AND notebook_id = $%d", len(args))
+	}
+	if len(opts.Tags) > 0 {
+		args = append(args, pq.Array(opts.Tags), len(opts.Tags))
+		query += fmt.Sprintf(` AND id IN (SELECT nt.note_id FROM note_tags AS nt JOIN tags AS t ON t.id = nt.tag_id
+			WHERE t.owner_id = $1 AND t.name = ANY($%d) GROUP BY nt.note_id HAVING count(*) = $%d)`, len(args)-1, len(args))
 	}
+	if !opts.UpdatedSince.IsZero() {
+		args = append(args, opts.UpdatedSince)
+		query += fmt.Sprintf(" AND updated_at >= $%d", len(args))
+	}
+	if after != nil {
+		args = append(args, after.sortKey(opts.Sort), after.ID)
+		query += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", column, cmp, len(args)-1, len(args))
+	}
+	// One extra row tells us whether there's another page
+	args = append(args, opts.Limit+1)
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column, dir, dir, len(args))
 
-	res, err := c.conn.Query("SELECT n.id FROM notes AS n JOIN users AS u ON n.owner_id = u.id WHERE u.id = ?", user)
+	res, err := c.conn.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error querying for notes: %v", err)
+		return nil, queryError(ctx, "querying for notes", err)
 	}
 	defer res.Close()
 
-	notes := []string{}
+	notes := []*Note{}
 	for res.Next() {
-		var noteID string
-		if err := res.Scan(&noteID); err != nil {
-			return nil, fmt.Errorf("error scanning results: %v", err)
+		n, err := scanNote(res)
+		if err != nil {
+			return nil, queryError(ctx, "scanning results", err)
 		}
-		notes = append(notes, noteID)
+		notes = append(notes, n)
 	}
 
 	if err := res.Err(); err != nil {
-		return nil, fmt.Errorf("error while parsing rows: %v", err)
+		return nil, queryError(ctx, "while parsing rows", err)
+	}
+	if opts.Full {
+		if err := loadNoteTags(ctx, c.conn, notes...); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewNoteList(notes, opts), nil
+}
+
+// GetNote returns a detailed note for a given note ID, provided it belongs
+// to the given user
+func (c *Conn) GetNote(ctx context.Context, user string, note string) (*Note, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, InvalidInput("note is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	n, err := scanNote(c.conn.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1 AND owner_id = $2", note, user))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoteNotFound
+	}
+	if err != nil {
+		return nil, queryError(ctx, "scanning results", err)
+	}
+	if err := loadNoteTags(ctx, c.conn, n); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// CreateNote creates a new note for the given user at the end of their list
+func (c *Conn) CreateNote(ctx context.Context, user string, note NewNote) (*Note, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	tags, err := CleanTagNames(note.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, queryError(ctx, "starting transaction", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockOwner(ctx, tx, user); err != nil {
+		return nil, err
+	}
+	if note.Notebook != "" {
+		if err := checkNotebook(ctx, tx, user, note.Notebook); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := scanNote(tx.QueryRowContext(ctx, `INSERT INTO notes (id, owner_id, data, sort_order, created_at, updated_at, notebook_id)
+		SELECT $1, $2, $3, COALESCE(MAX(sort_order), 0) + $4, now(), now(), NULLIF($5, '') FROM notes WHERE owner_id = $2
+		RETURNING `+noteColumns, id, user, note.Text, NoteRankGap, note.Notebook))
+	if err != nil {
+		return nil, queryError(ctx, "inserting note", err)
+	}
+	if err := addRevision(ctx, tx, id, note.Text, 0); err != nil {
+		return nil, err
+	}
+	if len(tags) > 0 {
+		if err := setNoteTags(ctx, tx, user, id, tags); err != nil {
+			return nil, err
+		}
+	}
+	n.Tags = tags
+
+	if err := tx.Commit(); err != nil {
+		return nil, queryError(ctx, "committing note", err)
+	}
+
+	return n, nil
+}
+
+// UpdateNote applies an update to a note owned by the given user and returns
+// the updated note
+func (c *Conn) UpdateNote(ctx context.Context, user string, note string, update NoteUpdate) (*Note, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, InvalidInput("note is empty")
+	}
+	var tags []string
+	if update.Tags != nil {
+		var err error
+		if tags, err = CleanTagNames(*update.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, queryError(ctx, "starting transaction", err)
+	}
+	defer tx.Rollback()
+
+	if update.Notebook != nil && *update.Notebook != "" {
+		if err := checkNotebook(ctx, tx, user, *update.Notebook); err != nil {
+			return nil, err
+		}
+	}
+
+	var notebook string
+	if update.Notebook != nil {
+		notebook = *update.Notebook
+	}
+	n, err := scanNote(tx.QueryRowContext(ctx, `UPDATE notes SET
+			data = COALESCE($3, data),
+			sort_order = COALESCE($4, sort_order),
+			notebook_id = CASE WHEN $5 THEN NULLIF($6, '') ELSE notebook_id END,
+			updated_at = now()
+		WHERE id = $1 AND owner_id = $2
+		RETURNING `+noteColumns,
+		note, user, update.Text, update.Order, update.Notebook != nil, notebook))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoteNotFound
+	}
+	if err != nil {
+		return nil, queryError(ctx, "updating note", err)
+	}
+
+	if update.Text != nil {
+		if err := addRevision(ctx, tx, note, *update.Text, 0); err != nil {
+			return nil, err
+		}
+	}
+	if update.Tags != nil {
+		if err := setNoteTags(ctx, tx, user, note, tags); err != nil {
+			return nil, err
+		}
+	}
+	if err := loadNoteTags(ctx, tx, n); err != nil {
+		return nil, err
+	}
+
+	// Orders are only checked to be unique on commit
+	err = tx.Commit()
+	if isUniqueViolation(err) {
+		return nil, ErrNoteOrderTaken
+	}
+	if err != nil {
+		return nil, queryError(ctx, "committing note update", err)
+	}
+
+	return n, nil
+}
+
+// DeleteNote deletes a note owned by the given user
+func (c *Conn) DeleteNote(ctx context.Context, user string, note string) error {
+	if user == "" {
+		return InvalidInput("user is empty")
 	}
+	if note == "" {
+		return InvalidInput("note is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
 
-	return &NoteList{Notes: notes}, nil
+	res, err := c.conn.ExecContext(ctx, "DELETE FROM notes WHERE id = $1 AND owner_id = $2", note, user)
+	if err != nil {
+		return queryError(ctx, "deleting note", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return queryError(ctx, "reading deleted rows", err)
+	}
+	if n == 0 {
+		return ErrNoteNotFound
+	}
+
+	return nil
 }
 
-// GetNote returns a detailed note for a given note ID
-func (c *Conn) GetNote(user string, note string) (*Note, error) {
+// MoveNote moves a note owned by the given user directly before or after
+// another of their notes, and returns the moved note
+func (c *Conn) MoveNote(ctx context.Context, user string, note string, move NoteMove) (*Note, error) {
 	if user == "" {
-		return nil, errors.New("user is empty")
+		return nil, InvalidInput("user is empty")
 	}
 	if note == "" {
-		return nil, errors.New("note is empty")
+		return nil, InvalidInput("note is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, queryError(ctx, "starting transaction", err)
+	}
+	defer tx.Rollback()
+
+	ranks, err := lockNoteRanks(ctx, tx, user)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := MoveRanks(ranks, note, move)
+	if err != nil {
+		return nil, err
+	}
+	if err := setNoteRanks(ctx, tx, user, changes); err != nil {
+		return nil, err
+	}
+
+	n, err := scanNote(tx.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1", note))
+	if err != nil {
+		return nil, queryError(ctx, "querying for moved note", err)
+	}
+	if err := loadNoteTags(ctx, tx, n); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, queryError(ctx, "committing note move", err)
+	}
+
+	return n, nil
+}
+
+// ReorderNotes puts all of a user's notes in the given order. It fails with
+// a conflict if notes doesn't list exactly the notes the user has.
+func (c *Conn) ReorderNotes(ctx context.Context, user string, notes []string) error {
+	if user == "" {
+		return InvalidInput("user is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return queryError(ctx, "starting transaction", err)
+	}
+	defer tx.Rollback()
+
+	ranks, err := lockNoteRanks(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+	changes, err := OrderRanks(ranks, notes)
+	if err != nil {
+		return err
+	}
+	if err := setNoteRanks(ctx, tx, user, changes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return queryError(ctx, "committing note order", err)
+	}
+
+	return nil
+}
+
+// lockOwner locks a user against changes to the order of their notes until
+// tx ends. Locking the owner rather than the notes also holds off notes
+// being created meanwhile.
+func lockOwner(ctx context.Context, tx *sql.Tx, user string) error {
+	var id string
+	err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR NO KEY UPDATE", user).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return queryError(ctx, "locking notes", err)
 	}
+	return nil
+}
 
-	var text string
-	var order int
-	var createdAt, updatedAt time.Time
-	err := c.conn.QueryRow("SELECT data, sort_order, created_at, updated_at FROM notes WHERE id = ?", note).Scan(&text, &order, &createdAt, &updatedAt)
+// lockNoteRanks locks a user's notes with lockOwner and returns them in
+// sort order
+func lockNoteRanks(ctx context.Context, tx *sql.Tx, user string) ([]NoteRank, error) {
+	if err := lockOwner(ctx, tx, user); err != nil {
+		return nil, err
+	}
+
+	res, err := tx.QueryContext(ctx, "SELECT id, sort_order FROM notes WHERE owner_id = $1 ORDER BY sort_order, id", user)
 	if err != nil {
-		return nil, fmt.Errorf("error scanning results: %v", err)
+		return nil, queryError(ctx, "querying for note order", err)
+	}
+	defer res.Close()
+
+	ranks := []NoteRank{}
+	for res.Next() {
+		var r NoteRank
+		if err := res.Scan(&r.ID, &r.Order); err != nil {
+			return nil, queryError(ctx, "scanning results", err)
+		}
+		ranks = append(ranks, r)
+	}
+	if err := res.Err(); err != nil {
+		return nil, queryError(ctx, "while parsing rows", err)
+	}
+	return ranks, nil
+}
+
+// setNoteRanks writes new sort orders. A note whose order changes counts as
+// updated. Uniqueness is only checked on commit, so notes can swap orders.
+func setNoteRanks(ctx context.Context, tx *sql.Tx, user string, changes map[string]int) error {
+	for id, order := range changes {
+		_, err := tx.ExecContext(ctx, "UPDATE notes SET sort_order = $3, updated_at = now() WHERE id = $1 AND owner_id = $2", id, user, order)
+		if err != nil {
+			return queryError(ctx, "updating note order", err)
+		}
+	}
+	return nil
+}
+
+// noteSortColumns maps each sort to the column it orders by
+var noteSortColumns = map[NoteSort]string{
+	SortOrder:     "sort_order",
+	SortCreatedAt: "created_at",
+	SortUpdatedAt: "updated_at",
+}
+
+// noteCursor is the position after the last note of a page. It's sent to
+// clients base64 encoded, they shouldn't rely on what's inside.
+type noteCursor struct {
+	Sort  NoteSort   `json:"s"`
+	Desc  bool       `json:"d,omitempty"`
+	ID    string     `json:"id"`
+	Order int        `json:"o,omitempty"`
+	Time  *time.Time `json:"t,omitempty"`
+}
+
+// Normalize fills in the defaults and checks the options, returning the
+// last note of the previous page as far as the cursor describes it
+func (o *NoteListOptions) Normalize() (*Note, error) {
+	if o.Sort == "" {
+		o.Sort = SortOrder
+	}
+	if _, ok := noteSortColumns[o.Sort]; !ok {
+		return nil, InvalidInput("can't sort notes by %q", o.Sort)
+	}
+	switch {
+	case o.Limit == 0:
+		o.Limit = DefaultNoteListLimit
+	case o.Limit < 0 || o.Limit > MaxNoteListLimit:
+		return nil, InvalidInput("limit must be between 1 and %d", MaxNoteListLimit)
+	}
+	if len(o.Tags) > 0 {
+		tags, err := CleanTagNames(o.Tags)
+		if err != nil {
+			return nil, err
+		}
+		o.Tags = tags
+	}
+	if o.Cursor == "" {
+		return nil, nil
+	}
+
+	var c noteCursor
+	b, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID == "" {
+		return nil, InvalidInput("invalid cursor")
+	}
+	if c.Sort != o.Sort || c.Desc != o.Desc {
+		return nil, InvalidInput("cursor is for a different sort")
 	}
 
-	return &Note{
-		ID:        note,
-		Text:      text,
-		Order:     order,
-		CreatedAt: createdAt,
-		UpdatedAt: updatedAt,
-	}, nil
+	after := &Note{ID: c.ID, Order: c.Order}
+	switch o.Sort {
+	case SortCreatedAt, SortUpdatedAt:
+		if c.Time == nil {
+			return nil, InvalidInput("invalid cursor")
+		}
+		after.CreatedAt, after.UpdatedAt = *c.Time, *c.Time
+	}
+	return after, nil
+}
+
+// Less reports whether note a comes before b in the list's sort. Ties are
+// broken by ID so every note has a stable place to page from.
+func (o NoteListOptions) Less(a, b *Note) bool {
+	less, equal := false, false
+	switch o.Sort {
+	case SortCreatedAt:
+		less, equal = a.CreatedAt.Before(b.CreatedAt), a.CreatedAt.Equal(b.CreatedAt)
+	case SortUpdatedAt:
+		less, equal = a.UpdatedAt.Before(b.UpdatedAt), a.UpdatedAt.Equal(b.UpdatedAt)
+	default:
+		less, equal = a.Order < b.Order, a.Order == b.Order
+	}
+	if equal {
+		less = strings.Compare(a.ID, b.ID) < 0
+	}
+	if o.Desc {
+		return !less && a.ID != b.ID
+	}
+	return less
+}
+
+// NewNoteList builds a page from up to opts.Limit+1 sorted notes, where an
+// extra note means there's a next page
+func NewNoteList(notes []*Note, opts NoteListOptions) *NoteList {
+	list := &NoteList{Notes: []string{}}
+	if len(notes) > opts.Limit {
+		notes = notes[:opts.Limit]
+		list.NextCursor = noteCursorFor(notes[len(notes)-1], opts)
+	}
+	for _, n := range notes {
+		list.Notes = append(list.Notes, n.ID)
+	}
+	if opts.Full {
+		list.Summaries = notes
+	}
+	return list
+}
+
+// noteCursorFor returns the cursor continuing after n
+func noteCursorFor(n *Note, opts NoteListOptions) string {
+	c := noteCursor{Sort: opts.Sort, Desc: opts.Desc, ID: n.ID}
+	switch opts.Sort {
+	case SortCreatedAt:
+		c.Time = &n.CreatedAt
+	case SortUpdatedAt:
+		c.Time = &n.UpdatedAt
+	default:
+		c.Order = n.Order
+	}
+	// Marshalling a struct of plain fields can't fail
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sortKey returns the value of n the sort orders by
+func (n *Note) sortKey(sort NoteSort) interface{} {
+	switch sort {
+	case SortCreatedAt:
+		return n.CreatedAt
+	case SortUpdatedAt:
+		return n.UpdatedAt
+	}
+	return n.Order
 }
@@ -0,0 +1,142 @@
+package db
+
+// NoteRankGap is the space left between the sort orders of neighbouring
+// notes, so a note can usually be moved by changing its own order alone
+const NoteRankGap = 1024
+
+// ErrNoteOrderTaken is returned when a note is given the same order as
+// another of its owner's notes
+var ErrNoteOrderTaken = &Error{Kind: KindConflict, Message: "another note already has that order"}
+
+// errStaleOrder is returned when a full ordering doesn't list the notes the
+// user has now, usually because another device added or deleted one
+var errStaleOrder = &Error{Kind: KindConflict, Message: "order doesn't match the current notes"}
+
+// NoteMove places a note directly before or after another note. Exactly
+// one of the two is set.
+type NoteMove struct {
+	Before string
+	After  string
+}
+
+// NoteRank is a note's place in its owner's list
+type NoteRank struct {
+	ID    string
+	Order int
+}
+
+// MoveRanks works out the new sort orders for a move, given a user's notes
+// in sort order. Usually only the moved note changes, but when there's no
+// gap left beside the target every note is spaced out again.
+func MoveRanks(ranks []NoteRank, note string, move NoteMove) (map[string]int, error) {
+	if (move.Before == "") == (move.After == "") {
+		return nil, InvalidInput("exactly one of before and after must be set")
+	}
+	target := move.Before
+	if target == "" {
+		target = move.After
+	}
+	if target == note {
+		return nil, InvalidInput("can't move a note relative to itself")
+	}
+
+	// Take the note out, then find where it goes in what's left
+	rest := make([]NoteRank, 0, len(ranks))
+	found := false
+	for _, r := range ranks {
+		if r.ID == note {
+			found = true
+			continue
+		}
+		rest = append(rest, r)
+	}
+	if !found {
+		return nil, ErrNoteNotFound
+	}
+	at := -1
+	for i, r := range rest {
+		if r.ID == target {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		return nil, ErrNoteNotFound
+	}
+	if move.After != "" {
+		at++
+	}
+
+	// The note goes between rest[at-1] and rest[at], either of which may
+	// not exist
+	var order int
+	switch {
+	case at == 0:
+		order = rest[0].Order - NoteRankGap
+	case at == len(rest):
+		order = rest[at-1].Order + NoteRankGap
+	default:
+		lo, hi := rest[at-1].Order, rest[at].Order
+		if hi-lo < 2 {
+			return spaceOut(rest, at, note), nil
+		}
+		order = lo + (hi-lo)/2
+	}
+	return map[string]int{note: order}, nil
+}
+
+// OrderRanks gives the notes new sort orders following ids, which must list
+// each of the user's notes exactly once. Notes already in place keep their
+// order.
+func OrderRanks(ranks []NoteRank, ids []string) (map[string]int, error) {
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id == "" {
+			return nil, InvalidInput("note is empty")
+		}
+		if seen[id] {
+			return nil, InvalidInput("note %s is listed twice", id)
+		}
+		seen[id] = true
+	}
+	if len(ids) != len(ranks) {
+		return nil, errStaleOrder
+	}
+	for _, r := range ranks {
+		if !seen[r.ID] {
+			return nil, errStaleOrder
+		}
+	}
+
+	current := make(map[string]int, len(ranks))
+	for _, r := range ranks {
+		current[r.ID] = r.Order
+	}
+	changes := make(map[string]int)
+	for i, id := range ids {
+		if order := (i + 1) * NoteRankGap; current[id] != order {
+			changes[id] = order
+		}
+	}
+	return changes, nil
+}
+
+// spaceOut renumbers every note with NoteRankGap between them, inserting
+// note at index at of rest
+func spaceOut(rest []NoteRank, at int, note string) map[string]int {
+	changes := make(map[string]int, len(rest)+1)
+	order := NoteRankGap
+	for i := 0; i <= len(rest); i++ {
+		if i == at {
+			changes[note] = order
+			order += NoteRankGap
+		}
+		if i < len(rest) {
+			if rest[i].Order != order {
+				changes[rest[i].ID] = order
+			}
+			order += NoteRankGap
+		}
+	}
+	return changes
+}
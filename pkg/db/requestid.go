@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/requestid"
+)
+
+// requestConn tags every statement with the request ID carried by its
+// context, as a leading SQL comment. Postgres keeps the comment in its logs
+// and in pg_stat_activity, so a slow or failing query can be tied to the
+// request that ran it.
+type requestConn struct {
+	driver.Conn
+}
+
+// tagQuery prefixes query with the request ID from ctx. IDs that could
+// close or nest the comment are left out rather than escaped.
+func tagQuery(ctx context.Context, query string) string {
+	id := requestid.FromContext(ctx)
+	if id == "" {
+		return query
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return query
+		}
+	}
+	return "/* request_id=" + id + " */ " + query
+}
+
+// QueryContext implements driver.QueryerContext
+func (c requestConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return q.QueryContext(ctx, tagQuery(ctx, query), args)
+}
+
+// ExecContext implements driver.ExecerContext
+func (c requestConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return e.ExecContext(ctx, tagQuery(ctx, query), args)
+}
+
+// PrepareContext implements driver.ConnPrepareContext
+func (c requestConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, tagQuery(ctx, query))
+	}
+	return c.Conn.Prepare(tagQuery(ctx, query))
+}
+
+// BeginTx implements driver.ConnBeginTx
+func (c requestConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// Ping implements driver.Pinger
+func (c requestConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrRevisionNotFound is returned when a note has no revision by that number
+var ErrRevisionNotFound = &Error{Kind: KindNotFound, Message: "revision not found"}
+
+// Revision is the text of a note as of one change. Revisions are numbered
+// from 1 for each note and never change once recorded.
+type Revision struct {
+	Revision  int       `json:"revision"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	// RestoredFrom is the older revision this one restored, if any
+	RestoredFrom int `json:"restored_from,omitempty"`
+}
+
+// RevisionList contains a note's revisions, newest first
+type RevisionList struct {
+	Revisions []*Revision `json:"revisions"`
+}
+
+// GetRevisions returns every revision of a note owned by the given user
+func (c *Conn) GetRevisions(ctx context.Context, user string, note string) (*RevisionList, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, InvalidInput("note is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	res, err := c.conn.QueryContext(ctx, `SELECT r.revision, r.data, r.created_at, r.restored_from
+		FROM note_revisions AS r JOIN notes AS n ON n.id = r.note_id
+		WHERE n.id = $1 AND n.owner_id = $2
+		ORDER BY r.revision DESC`, note, user)
+	if err != nil {
+		return nil, queryError(ctx, "querying for revisions", err)
+	}
+	defer res.Close()
+
+	revisions := []*Revision{}
+	for res.Next() {
+		var r Revision
+		var restoredFrom sql.NullInt64
+		if err := res.Scan(&r.Revision, &r.Text, &r.CreatedAt, &restoredFrom); err != nil {
+			return nil, queryError(ctx, "scanning results", err)
+		}
+		r.RestoredFrom = int(restoredFrom.Int64)
+		revisions = append(revisions, &r)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, queryError(ctx, "while parsing rows", err)
+	}
+	// Every note has at least the revision it was created with
+	if len(revisions) == 0 {
+		return nil, ErrNoteNotFound
+	}
+
+	return &RevisionList{Revisions: revisions}, nil
+}
+
+// GetRevision returns one revision of a note owned by the given user
+func (c *Conn) GetRevision(ctx context.Context, user string, note string, revision int) (*Revision, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, InvalidInput("note is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	return getRevision(ctx, c.conn, user, note, revision)
+}
+
+// RestoreRevision makes an older revision's text the current text of a note
+// owned by the given user, recording it as a new revision. Restoring the
+// current text changes nothing, not even the note's update time.
+func (c *Conn) RestoreRevision(ctx context.Context, user string, note string, revision int) (*Note, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if note == "" {
+		return nil, InvalidInput("note is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, queryError(ctx, "starting transaction", err)
+	}
+	defer tx.Rollback()
+
+	old, err := getRevision(ctx, tx, user, note, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// The right hand side sees the old data, and addRevision skips the
+	// revision too when it's unchanged
+	n, err := scanNote(tx.QueryRowContext(ctx, `UPDATE notes
+		SET data = $3, updated_at = CASE WHEN data IS DISTINCT FROM $3 THEN now() ELSE updated_at END
+		WHERE id = $1 AND owner_id = $2 RETURNING `+noteColumns,
+		note, user, old.Text))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoteNotFound
+	}
+	if err != nil {
+		return nil, queryError(ctx, "restoring note", err)
+	}
+	if err := addRevision(ctx, tx, note, old.Text, revision); err != nil {
+		return nil, err
+	}
+	if err := loadNoteTags(ctx, tx, n); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, queryError(ctx, "committing note restore", err)
+	}
+
+	return n, nil
+}
+
+// getRevision returns a revision of a note, telling a missing note apart
+// from a missing revision
+func getRevision(ctx context.Context, q querier, user string, note string, revision int) (*Revision, error) {
+	var number, restoredFrom sql.NullInt64
+	var text sql.NullString
+	var createdAt sql.NullTime
+	err := q.QueryRowContext(ctx, `SELECT r.revision, r.data, r.created_at, r.restored_from
+		FROM notes AS n LEFT JOIN note_revisions AS r ON r.note_id = n.id AND r.revision = $3
+		WHERE n.id = $1 AND n.owner_id = $2`, note, user, revision).Scan(&number, &text, &createdAt, &restoredFrom)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoteNotFound
+	}
+	if err != nil {
+		return nil, queryError(ctx, "querying for revision", err)
+	}
+	if !number.Valid {
+		return nil, ErrRevisionNotFound
+	}
+
+	return &Revision{
+		Revision:     int(number.Int64),
+		Text:         text.String,
+		CreatedAt:    createdAt.Time,
+		RestoredFrom: int(restoredFrom.Int64),
+	}, nil
+}
+
+// addRevision records text as the next revision of a note, unless it's the
+// same as the latest one. restoredFrom is the revision it restores, or 0.
+// The caller must have locked the note's row, which keeps revision numbers
+// from being taken twice.
+func addRevision(ctx context.Context, tx *sql.Tx, note string, text string, restoredFrom int) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO note_revisions (note_id, revision, data, restored_from)
+		SELECT $1, COALESCE(MAX(revision), 0) + 1, $2, NULLIF($3, 0) FROM note_revisions WHERE note_id = $1
+		HAVING $2 IS DISTINCT FROM (SELECT data FROM note_revisions WHERE note_id = $1 ORDER BY revision DESC LIMIT 1)`,
+		note, text, restoredFrom)
+	if err != nil {
+		return queryError(ctx, "inserting revision", err)
+	}
+	return nil
+}
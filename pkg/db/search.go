@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DefaultSearchLimit is the number of search results when none is asked
+	// for
+	DefaultSearchLimit = 20
+	// MaxSearchLimit is the most search results returned at once
+	MaxSearchLimit = 100
+	// maxSearchTerms caps the words and phrases in a query, so one request
+	// can't build an enormous tsquery
+	maxSearchTerms = 16
+
+	// HighlightStart and HighlightEnd surround matches in search snippets.
+	// The rest of a snippet is HTML escaped.
+	HighlightStart = "<mark>"
+	HighlightEnd   = "</mark>"
+)
+
+// SearchResult is a note matching a search, with its relevance and an
+// excerpt highlighting the matches
+type SearchResult struct {
+	Note    *Note   `json:"note"`
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// SearchResults is the response to a search, best match first
+type SearchResults struct {
+	Results []*SearchResult `json:"results"`
+}
+
+// SearchTerm is a word, or a phrase of consecutive words, that a note must
+// contain. With Prefix the last word only needs to start a word in the note.
+type SearchTerm struct {
+	Words  []string
+	Prefix bool
+}
+
+// SearchToken is a word of text, lowercased, and where it is in the text
+type SearchToken struct {
+	Word       string
+	Start, End int
+}
+
+// SearchTokens splits text into words, runs of letters and digits
+func SearchTokens(text string) []SearchToken {
+	var tokens []SearchToken
+	start := -1
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			tokens = append(tokens, SearchToken{Word: strings.ToLower(text[start:i]), Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, SearchToken{Word: strings.ToLower(text[start:]), Start: start, End: len(text)})
+	}
+	return tokens
+}
+
+// ParseSearch parses a search query. Notes must match every term; words in
+// double quotes are a phrase, and a word ending in * matches as a prefix.
+func ParseSearch(q string) ([]SearchTerm, error) {
+	var terms []SearchTerm
+	add := func(part string, phrase bool) {
+		var words []string
+		for _, t := range SearchTokens(part) {
+			words = append(words, t.Word)
+		}
+		if len(words) == 0 {
+			return
+		}
+		if phrase {
+			terms = append(terms, SearchTerm{Words: words, Prefix: strings.HasSuffix(strings.TrimSpace(part), "*")})
+			return
+		}
+		// Outside quotes every word is a term of its own
+		for i, t := range SearchTokens(part) {
+			prefix := strings.HasPrefix(part[t.End:], "*")
+			terms = append(terms, SearchTerm{Words: words[i : i+1], Prefix: prefix})
+		}
+	}
+
+	// Quotes alternate between plain words and phrases, and an unclosed
+	// quote runs to the end
+	for i, part := range strings.Split(q, `"`) {
+		add(part, i%2 == 1)
+	}
+
+	if len(terms) == 0 {
+		return nil, InvalidInput("search query has no words")
+	}
+	if len(terms) > maxSearchTerms {
+		return nil, InvalidInput("search query has more than %d words and phrases", maxSearchTerms)
+	}
+	return terms, nil
+}
+
+// tsquery renders terms as a Postgres tsquery. Words only hold letters and
+// digits, so they need no quoting.
+func tsquery(terms []SearchTerm) string {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		q := strings.Join(term.Words, " <-> ")
+		if term.Prefix {
+			q += ":*"
+		}
+		if len(term.Words) > 1 {
+			q = "(" + q + ")"
+		}
+		parts = append(parts, q)
+	}
+	return strings.Join(parts, " & ")
+}
+
+// SearchLimit checks a search limit, filling in the default
+func SearchLimit(limit int) (int, error) {
+	switch {
+	case limit == 0:
+		return DefaultSearchLimit, nil
+	case limit < 0 || limit > MaxSearchLimit:
+		return 0, InvalidInput("limit must be between 1 and %d", MaxSearchLimit)
+	}
+	return limit, nil
+}
+
+// SearchNotes returns the user's notes matching a query, see ParseSearch,
+// best match first. Words are matched by their English stems, so a search
+// for frogs finds frog.
+func (c *Conn) SearchNotes(ctx context.Context, user string, q string, limit int) (*SearchResults, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	terms, err := ParseSearch(q)
+	if err != nil {
+		return nil, err
+	}
+	if limit, err = SearchLimit(limit); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	// The headline is built from escaped text, so the only markup in it is
+	// the highlighting
+	res, err := c.conn.QueryContext(ctx, `SELECT `+noteColumns+`, ts_rank(search, query) AS rank,
+			ts_headline('english', replace(replace(replace(data, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), query, $3)
+		FROM notes, to_tsquery('english', $2) AS query
+		WHERE owner_id = $1 AND search @@ query
+		ORDER BY rank DESC, id
+		LIMIT $4`,
+		user, tsquery(terms), "StartSel="+HighlightStart+", StopSel="+HighlightEnd+", MinWords=15, MaxWords=35", limit)
+	if err != nil {
+		return nil, queryError(ctx, "searching notes", err)
+	}
+	defer res.Close()
+
+	results := &SearchResults{Results: []*SearchResult{}}
+	var notes []*Note
+	for res.Next() {
+		r := &SearchResult{}
+		if r.Note, err = scanNote(res, &r.Rank, &r.Snippet); err != nil {
+			return nil, queryError(ctx, "scanning results", err)
+		}
+		results.Results = append(results.Results, r)
+		notes = append(notes, r.Note)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, queryError(ctx, "while parsing rows", err)
+	}
+	if err := loadNoteTags(ctx, c.conn, notes...); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
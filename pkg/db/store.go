@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// NoteStore reads and writes notes. Every method is scoped to the owning
+// user, and notes belonging to someone else behave as if they don't exist.
+type NoteStore interface {
+	GetNoteList(ctx context.Context, user string, opts NoteListOptions) (*NoteList, error)
+	GetNote(ctx context.Context, user string, note string) (*Note, error)
+	CreateNote(ctx context.Context, user string, note NewNote) (*Note, error)
+	UpdateNote(ctx context.Context, user string, note string, update NoteUpdate) (*Note, error)
+	DeleteNote(ctx context.Context, user string, note string) error
+	MoveNote(ctx context.Context, user string, note string, move NoteMove) (*Note, error)
+	ReorderNotes(ctx context.Context, user string, notes []string) error
+	SearchNotes(ctx context.Context, user string, q string, limit int) (*SearchResults, error)
+}
+
+// TagStore manages a user's tags. Notes are tagged through NoteStore.
+type TagStore interface {
+	GetTags(ctx context.Context, user string) (*TagList, error)
+	CreateTag(ctx context.Context, user string, name string) (*Tag, error)
+	RenameTag(ctx context.Context, user string, tag string, name string) (*Tag, error)
+	DeleteTag(ctx context.Context, user string, tag string) error
+}
+
+// NotebookStore manages a user's notebooks. Notes are put in notebooks
+// through NoteStore.
+type NotebookStore interface {
+	GetNotebooks(ctx context.Context, user string) (*NotebookList, error)
+	GetNotebook(ctx context.Context, user string, notebook string) (*Notebook, error)
+	CreateNotebook(ctx context.Context, user string, name string) (*Notebook, error)
+	RenameNotebook(ctx context.Context, user string, notebook string, name string) (*Notebook, error)
+	DeleteNotebook(ctx context.Context, user string, notebook string) error
+}
+
+// RevisionStore reads and restores the history of a note's text. Revisions
+// are recorded by NoteStore as notes are created and updated.
+type RevisionStore interface {
+	GetRevisions(ctx context.Context, user string, note string) (*RevisionList, error)
+	GetRevision(ctx context.Context, user string, note string, revision int) (*Revision, error)
+	RestoreRevision(ctx context.Context, user string, note string, revision int) (*Note, error)
+}
+
+// UserStore registers users and checks their credentials
+type UserStore interface {
+	CreateUser(ctx context.Context, username, password string) (*User, error)
+	VerifyUser(ctx context.Context, username, password string) (*User, error)
+}
+
+// TokenStore persists refresh tokens
+type TokenStore interface {
+	CreateRefreshToken(ctx context.Context, user, token string, expiresAt time.Time) error
+	RotateRefreshToken(ctx context.Context, oldToken, newToken string, expiresAt time.Time) (string, error)
+}
+
+// HealthStore reports on the health of the underlying storage
+type HealthStore interface {
+	// Ping checks that storage is reachable
+	Ping(ctx context.Context) error
+	// SchemaVersion returns the version of the latest applied migration
+	SchemaVersion(ctx context.Context) (int, error)
+}
+
+// Store is everything the API needs from persistent storage. Conn implements
+// it on top of Postgres, and pkg/db/memory implements it in memory.
+type Store interface {
+	NoteStore
+	TagStore
+	NotebookStore
+	RevisionStore
+	UserStore
+	TokenStore
+	HealthStore
+}
+
+var _ Store = (*Conn)(nil)
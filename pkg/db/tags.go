@@ -0,0 +1,287 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// maxNameLen is the most characters in a tag or notebook name
+	maxNameLen = 64
+	// maxNoteTags is the most tags on one note
+	maxNoteTags = 32
+)
+
+var (
+	// ErrTagNotFound is returned when a tag doesn't exist or belongs to a
+	// different user
+	ErrTagNotFound = &Error{Kind: KindNotFound, Message: "tag not found"}
+	// ErrTagExists is returned when a user already has a tag by that name
+	ErrTagExists = &Error{Kind: KindConflict, Message: "tag already exists"}
+)
+
+// Tag is a label a user can put on any number of their notes
+type Tag struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Notes is the number of notes with the tag
+	Notes int `json:"notes"`
+}
+
+// TagList contains a user's tags, by name
+type TagList struct {
+	Tags []*Tag `json:"tags"`
+}
+
+// CleanName trims a tag or notebook name and checks it's acceptable
+func CleanName(kind, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", InvalidInput("%s name is empty", kind)
+	}
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxNameLen {
+		return "", InvalidInput("%s name must be at most %d characters of valid UTF-8", kind, maxNameLen)
+	}
+	return name, nil
+}
+
+// CleanTagNames cleans the tag names for a note, dropping duplicates, and
+// returns them sorted
+func CleanTagNames(names []string) ([]string, error) {
+	seen := make(map[string]bool, len(names))
+	cleaned := []string{}
+	for _, name := range names {
+		name, err := CleanName("tag", name)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[name] {
+			seen[name] = true
+			cleaned = append(cleaned, name)
+		}
+	}
+	if len(cleaned) > maxNoteTags {
+		return nil, InvalidInput("a note can have at most %d tags", maxNoteTags)
+	}
+	sort.Strings(cleaned)
+	return cleaned, nil
+}
+
+// GetTags returns a user's tags with the number of notes carrying each
+func (c *Conn) GetTags(ctx context.Context, user string) (*TagList, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	res, err := c.conn.QueryContext(ctx, `SELECT t.id, t.name, t.created_at, count(nt.note_id)
+		FROM tags AS t LEFT JOIN note_tags AS nt ON nt.tag_id = t.id
+		WHERE t.owner_id = $1
+		GROUP BY t.id
+		ORDER BY t.name`, user)
+	if err != nil {
+		return nil, queryError(ctx, "querying for tags", err)
+	}
+	defer res.Close()
+
+	tags := []*Tag{}
+	for res.Next() {
+		var t Tag
+		if err := res.Scan(&t.ID, &t.Name, &t.CreatedAt, &t.Notes); err != nil {
+			return nil, queryError(ctx, "scanning results", err)
+		}
+		tags = append(tags, &t)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, queryError(ctx, "while parsing rows", err)
+	}
+
+	return &TagList{Tags: tags}, nil
+}
+
+// CreateTag creates a tag for the given user
+func (c *Conn) CreateTag(ctx context.Context, user string, name string) (*Tag, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	name, err := CleanName("tag", name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	t := Tag{ID: id, Name: name}
+	err = c.conn.QueryRowContext(ctx, "INSERT INTO tags (id, owner_id, name) VALUES ($1, $2, $3) RETURNING created_at",
+		id, user, name).Scan(&t.CreatedAt)
+	if isUniqueViolation(err) {
+		return nil, ErrTagExists
+	}
+	// The owner is the only row a tag references
+	if isForeignKeyViolation(err) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, queryError(ctx, "inserting tag", err)
+	}
+
+	return &t, nil
+}
+
+// RenameTag renames a tag owned by the given user, which renames it on every
+// note carrying it
+func (c *Conn) RenameTag(ctx context.Context, user string, tag string, name string) (*Tag, error) {
+	if user == "" {
+		return nil, InvalidInput("user is empty")
+	}
+	if tag == "" {
+		return nil, InvalidInput("tag is empty")
+	}
+	name, err := CleanName("tag", name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	t := Tag{ID: tag}
+	err = c.conn.QueryRowContext(ctx, `UPDATE tags SET name = $3 WHERE id = $1 AND owner_id = $2
+		RETURNING name, created_at, (SELECT count(*) FROM note_tags WHERE tag_id = $1)`,
+		tag, user, name).Scan(&t.Name, &t.CreatedAt, &t.Notes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTagNotFound
+	}
+	if isUniqueViolation(err) {
+		return nil, ErrTagExists
+	}
+	if err != nil {
+		return nil, queryError(ctx, "updating tag", err)
+	}
+
+	return &t, nil
+}
+
+// DeleteTag deletes a tag owned by the given user, taking it off every note
+func (c *Conn) DeleteTag(ctx context.Context, user string, tag string) error {
+	if user == "" {
+		return InvalidInput("user is empty")
+	}
+	if tag == "" {
+		return InvalidInput("tag is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	res, err := c.conn.ExecContext(ctx, "DELETE FROM tags WHERE id = $1 AND owner_id = $2", tag, user)
+	if err != nil {
+		return queryError(ctx, "deleting tag", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return queryError(ctx, "reading deleted rows", err)
+	}
+	if n == 0 {
+		return ErrTagNotFound
+	}
+
+	return nil
+}
+
+// setNoteTags replaces a note's tags with the named ones, creating any the
+// user doesn't have yet
+func setNoteTags(ctx context.Context, tx *sql.Tx, user string, note string, names []string) error {
+	for _, name := range names {
+		id, err := NewID()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO tags (id, owner_id, name) VALUES ($1, $2, $3) ON CONFLICT (owner_id, name) DO NOTHING", id, user, name)
+		if err != nil {
+			return queryError(ctx, "inserting tag", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM note_tags WHERE note_id = $1", note); err != nil {
+		return queryError(ctx, "removing note tags", err)
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO note_tags (note_id, tag_id) SELECT $1, id FROM tags WHERE owner_id = $2 AND name = ANY($3)",
+		note, user, pq.Array(names))
+	if err != nil {
+		return queryError(ctx, "tagging note", err)
+	}
+	return nil
+}
+
+// querier is the part of *sql.DB and *sql.Tx used by helpers that run
+// either in or outside a transaction
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// loadNoteTags fills in the tags of notes
+func loadNoteTags(ctx context.Context, q querier, notes ...*Note) error {
+	byID := make(map[string]*Note, len(notes))
+	ids := make([]string, 0, len(notes))
+	for _, n := range notes {
+		n.Tags = []string{}
+		byID[n.ID] = n
+		ids = append(ids, n.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	res, err := q.QueryContext(ctx, `SELECT nt.note_id, t.name FROM note_tags AS nt JOIN tags AS t ON t.id = nt.tag_id
+		WHERE nt.note_id = ANY($1) ORDER BY t.name`, pq.Array(ids))
+	if err != nil {
+		return queryError(ctx, "querying for note tags", err)
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var note, name string
+		if err := res.Scan(&note, &name); err != nil {
+			return queryError(ctx, "scanning results", err)
+		}
+		byID[note].Tags = append(byID[note].Tags, name)
+	}
+
+	if err := res.Err(); err != nil {
+		return queryError(ctx, "while parsing rows", err)
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is postgres rejecting a duplicate
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation
+}
+
+// isForeignKeyViolation reports whether err is a postgres foreign key
+// violation
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqForeignKeyViolation
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked
+	// refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token
+	// is presented again. The whole token family is revoked when this happens.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// CreateRefreshToken stores a refresh token for a user as the first member
+// of a new token family. Only a hash of the token is persisted.
+func (c *Conn) CreateRefreshToken(ctx context.Context, user, token string, expiresAt time.Time) error {
+	if user == "" {
+		return InvalidInput("user is empty")
+	}
+	if token == "" {
+		return InvalidInput("token is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	id, err := NewID()
+	if err != nil {
+		return err
+	}
+
+	// The first token in a family shares its ID with the family
+	_, err = c.conn.ExecContext(ctx, "INSERT INTO refresh_tokens (id, family_id, user_id, token_hash, expires_at) VALUES ($1, $1, $2, $3, $4)",
+		id, user, auth.HashRefreshToken(token), expiresAt)
+	if err != nil {
+		return queryError(ctx, "inserting refresh token", err)
+	}
+
+	return nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// family, returning the user the tokens belong to. Each token may be used
+// once; presenting a used token revokes every token in its family and
+// returns ErrRefreshTokenReused.
+func (c *Conn) RotateRefreshToken(ctx context.Context, oldToken, newToken string, expiresAt time.Time) (string, error) {
+	if oldToken == "" {
+		return "", ErrInvalidRefreshToken
+	}
+	if newToken == "" {
+		return "", errors.New("new token is empty")
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", queryError(ctx, "starting transaction", err)
+	}
+	defer tx.Rollback()
+
+	var id, family, user string
+	var tokenExpiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	// Lock the row so two concurrent refreshes with the same token can't
+	// both see it as unused
+	err = tx.QueryRowContext(ctx, "SELECT id, family_id, user_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE",
+		auth.HashRefreshToken(oldToken)).Scan(&id, &family, &user, &tokenExpiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return "", queryError(ctx, "querying for refresh token", err)
+	}
+
+	if revokedAt.Valid {
+		return "", ErrInvalidRefreshToken
+	}
+
+	if usedAt.Valid {
+		// Someone is replaying a token that has already been rotated, so
+		// either the client or an attacker holds a stolen copy. Revoke the
+		// family so neither can continue.
+		_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL", family)
+		if err != nil {
+			return "", queryError(ctx, "revoking refresh token family", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return "", queryError(ctx, "committing refresh token revocation", err)
+		}
+		return "", ErrRefreshTokenReused
+	}
+
+	if time.Now().After(tokenExpiresAt) {
+		return "", ErrInvalidRefreshToken
+	}
+
+	nextID, err := NewID()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = now(), replaced_by = $2 WHERE id = $1", id, nextID)
+	if err != nil {
+		return "", queryError(ctx, "marking refresh token used", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO refresh_tokens (id, family_id, user_id, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		nextID, family, user, auth.HashRefreshToken(newToken), expiresAt)
+	if err != nil {
+		return "", queryError(ctx, "inserting refresh token", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", queryError(ctx, "committing refresh token rotation", err)
+	}
+
+	return user, nil
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/voyagerstudio/haiku-auth/pkg/auth"
+)
+
+var (
+	// ErrUserExists is returned when registering a username that is taken
+	ErrUserExists = &Error{Kind: KindConflict, Message: "user already exists"}
+	// ErrUserNotFound is returned when creating something for a user that
+	// doesn't exist, e.g. one deleted since their token was issued
+	ErrUserNotFound = &Error{Kind: KindNotFound, Message: "user not found"}
+	// ErrInvalidCredentials is returned when a username or password is wrong
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+const (
+	// pqUniqueViolation is the postgres error code for a unique constraint
+	// failure
+	pqUniqueViolation = "23505"
+	// pqForeignKeyViolation is the postgres error code for a reference to a
+	// missing row
+	pqForeignKeyViolation = "23503"
+)
+
+// User contains the public details of a registered user
+type User struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateUser registers a new user, storing a salted hash of their password
+func (c *Conn) CreateUser(ctx context.Context, username, password string) (*User, error) {
+	if username == "" {
+		return nil, InvalidInput("username is empty")
+	}
+	if password == "" {
+		return nil, InvalidInput("password is empty")
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing password: %v", err)
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	var createdAt time.Time
+	err = c.conn.QueryRowContext(ctx, "INSERT INTO users (id, username, password_hash) VALUES ($1, $2, $3) RETURNING created_at", id, username, hash).Scan(&createdAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+			return nil, ErrUserExists
+		}
+		return nil, queryError(ctx, "inserting user", err)
+	}
+
+	return &User{
+		ID:        id,
+		Username:  username,
+		CreatedAt: createdAt,
+	}, nil
+}
+
+// VerifyUser checks a username and password, returning the matching user.
+// Unknown usernames and wrong passwords both return ErrInvalidCredentials.
+func (c *Conn) VerifyUser(ctx context.Context, username, password string) (*User, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var id, hash string
+	var createdAt time.Time
+	err := c.conn.QueryRowContext(ctx, "SELECT id, password_hash, created_at FROM users WHERE username = $1", username).Scan(&id, &hash, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Hash anyway so that unknown usernames take as long as known ones
+		auth.HashPassword(password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, queryError(ctx, "querying for user", err)
+	}
+
+	if err := auth.ComparePassword(hash, password); err != nil {
+		if errors.Is(err, auth.ErrMismatchedPassword) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("error comparing password: %v", err)
+	}
+
+	return &User{
+		ID:        id,
+		Username:  username,
+		CreatedAt: createdAt,
+	}, nil
+}
@@ -0,0 +1,165 @@
+// Package diff compares two texts line by line, with Myers' algorithm for the
+// shortest edit script. Texts too different to diff cheaply are shown as one
+// text replacing the other.
+package diff
+
+import "strings"
+
+// maxEdits bounds the work done finding the shortest edit script. Past this
+// many inserted and deleted lines, whatever is left differs as a whole.
+const maxEdits = 1000
+
+// Op is what happened to a line between the two texts
+type Op string
+
+const (
+	Equal  Op = "equal"
+	Insert Op = "insert"
+	Delete Op = "delete"
+)
+
+// Line is one line of a diff
+type Line struct {
+	Op   Op     `json:"op"`
+	Text string `json:"text"`
+	// Old and New are the line's 1-based numbers in each text, 0 in the text
+	// it isn't in
+	Old int `json:"old,omitempty"`
+	New int `json:"new,omitempty"`
+}
+
+// Lines diffs text a against b. Lines are separated by newlines, and a
+// trailing newline doesn't start another line.
+func Lines(a, b string) []Line {
+	x, y := splitLines(a), splitLines(b)
+
+	// Common ends are cheap to find, and leave less for the search
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]Op, 0, len(x)+len(y))
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, Equal)
+	}
+	ops = append(ops, edits(x[prefix:len(x)-suffix], y[prefix:len(y)-suffix])...)
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, Equal)
+	}
+
+	lines := make([]Line, 0, len(ops))
+	i, j := 0, 0
+	for _, op := range ops {
+		switch op {
+		case Equal:
+			lines = append(lines, Line{Op: Equal, Text: x[i], Old: i + 1, New: j + 1})
+			i++
+			j++
+		case Delete:
+			lines = append(lines, Line{Op: Delete, Text: x[i], Old: i + 1})
+			i++
+		case Insert:
+			lines = append(lines, Line{Op: Insert, Text: y[j], New: j + 1})
+			j++
+		}
+	}
+	return lines
+}
+
+// splitLines splits text into lines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// edits returns the shortest edit script turning a into b, or deletes all
+// of a and inserts all of b if that takes more than maxEdits
+func edits(a, b []string) []Op {
+	n, m := len(a), len(b)
+	// v[offset+k] is the furthest x reached on diagonal k = x - y, and
+	// trace[d] is v over diagonals -d to d after d edits
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= n+m && d <= maxEdits; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		// The end is on diagonal n - m, which step d only reaches if it has
+		// the same parity
+		if k := n - m; k >= -d && k <= d && (k+d)%2 == 0 && v[offset+k] >= n {
+			return backtrack(trace, n, m)
+		}
+	}
+
+	ops := make([]Op, 0, n+m)
+	for i := 0; i < n; i++ {
+		ops = append(ops, Delete)
+	}
+	for i := 0; i < m; i++ {
+		ops = append(ops, Insert)
+	}
+	return ops
+}
+
+// backtrack follows trace back from the end of both texts to the start, and
+// returns the edits taken in order
+func backtrack(trace [][]int, n, m int) []Op {
+	var ops []Op
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, Equal)
+			x--
+			y--
+		}
+		if prevK == k+1 {
+			ops = append(ops, Insert)
+			y--
+		} else {
+			ops = append(ops, Delete)
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, Equal)
+		x--
+		y--
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
@@ -0,0 +1,86 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLines(t *testing.T) {
+	lines := Lines("an old pond\na frog jumps in\nsound of water\n", "an old pond\na frog leaps in\nsound of water\nsplash")
+	require.Equal(t, []Line{
+		{Op: Equal, Text: "an old pond", Old: 1, New: 1},
+		{Op: Delete, Text: "a frog jumps in", Old: 2},
+		{Op: Insert, Text: "a frog leaps in", New: 2},
+		{Op: Equal, Text: "sound of water", Old: 3, New: 3},
+		{Op: Insert, Text: "splash", New: 4},
+	}, lines)
+
+	require.Empty(t, Lines("", ""))
+	require.Equal(t, []Line{{Op: Insert, Text: "pond", New: 1}}, Lines("", "pond"))
+	require.Equal(t, []Line{{Op: Delete, Text: "pond", Old: 1}}, Lines("pond\n", ""))
+}
+
+func TestLinesShortest(t *testing.T) {
+	for _, c := range []struct{ a, b string }{
+		{"a b c a b b a", "c b a b a c"},
+		{"x y z", "z y x"},
+		{"a a a", "a"},
+		{"a b", "c d"},
+		{"", "a b c"},
+	} {
+		a, b := strings.ReplaceAll(c.a, " ", "\n"), strings.ReplaceAll(c.b, " ", "\n")
+		lines := Lines(a, b)
+
+		// Applying the diff gives back both texts
+		var old, new []string
+		edits := 0
+		for _, l := range lines {
+			if l.Op != Insert {
+				old = append(old, l.Text)
+			}
+			if l.Op != Delete {
+				new = append(new, l.Text)
+			}
+			if l.Op != Equal {
+				edits++
+			}
+		}
+		require.Equal(t, splitLines(a), old, c.a)
+		require.Equal(t, splitLines(b), new, c.b)
+
+		x, y := splitLines(a), splitLines(b)
+		require.Equal(t, len(x)+len(y)-2*lcs(x, y), edits, "%q to %q", c.a, c.b)
+	}
+}
+
+func TestLinesTooDifferent(t *testing.T) {
+	a := strings.Repeat("a\n", maxEdits)
+	b := strings.Repeat("b\n", maxEdits)
+	lines := Lines(a, b)
+	require.Len(t, lines, 2*maxEdits)
+	require.Equal(t, Delete, lines[0].Op)
+	require.Equal(t, Insert, lines[len(lines)-1].Op)
+}
+
+// lcs is the length of the longest common subsequence, the slow way
+func lcs(a, b []string) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				dp[i][j] = dp[i+1][j+1] + 1
+			case dp[i+1][j] > dp[i][j+1]:
+				dp[i][j] = dp[i+1][j]
+			default:
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+	return dp[0][0]
+}
@@ -0,0 +1,174 @@
+// Package haiku checks text against the 5-7-5 form of an English haiku.
+// Syllables are estimated, from a dictionary of words the rules get wrong
+// and spelling rules for everything else, so the count is occasionally off
+// by one on unusual words.
+package haiku
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Form is the number of syllables in each line of a haiku
+var Form = []int{5, 7, 5}
+
+// Line is one line of text and its estimated syllables
+type Line struct {
+	Text      string `json:"text"`
+	Syllables int    `json:"syllables"`
+}
+
+// Analysis is how closely text follows the haiku form
+type Analysis struct {
+	Lines []Line `json:"lines"`
+	// Pattern is the syllables per line, e.g. 5-7-5
+	Pattern string `json:"pattern"`
+	// Conforms reports whether the lines match Form exactly
+	Conforms bool `json:"conforms"`
+}
+
+// Analyze splits text into lines and counts the syllables in each. Lines are
+// separated by newlines, or by slashes for a haiku written on one line, and
+// blank lines are ignored.
+func Analyze(text string) *Analysis {
+	a := &Analysis{Lines: []Line{}}
+	counts := []string{}
+	for _, line := range splitLines(text) {
+		n := CountLine(line)
+		a.Lines = append(a.Lines, Line{Text: line, Syllables: n})
+		counts = append(counts, strconv.Itoa(n))
+	}
+	a.Pattern = strings.Join(counts, "-")
+
+	a.Conforms = len(a.Lines) == len(Form)
+	for i := 0; a.Conforms && i < len(Form); i++ {
+		a.Conforms = a.Lines[i].Syllables == Form[i]
+	}
+	return a
+}
+
+// splitLines returns the non-blank lines of text, trimmed
+func splitLines(text string) []string {
+	sep := "\n"
+	if !strings.Contains(strings.TrimSpace(text), "\n") {
+		sep = "/"
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(text, sep) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// CountLine estimates the syllables in a line of text. Hyphenated words
+// count as their parts, and numbers aren't counted.
+func CountLine(line string) int {
+	n := 0
+	for _, word := range strings.FieldsFunc(line, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-' || r == '—' || r == '–'
+	}) {
+		n += Syllables(word)
+	}
+	return n
+}
+
+// Syllables estimates the syllables in a single word, ignoring case and
+// punctuation. It returns 0 for anything without letters.
+func Syllables(word string) int {
+	w := normalize(word)
+	if w == "" {
+		return 0
+	}
+	if n, ok := dictionary[w]; ok {
+		return n
+	}
+	// Possessives and contractions don't add a syllable, apart from after a
+	// sibilant, e.g. horse's, which the -es rule handles
+	if base := strings.TrimSuffix(w, "'s"); base != w {
+		if n, ok := dictionary[base]; ok && !sibilant(base) {
+			return n
+		}
+	}
+	return estimate(strings.ReplaceAll(w, "'", ""))
+}
+
+// normalize lowercases word and strips everything but letters and inner
+// apostrophes
+func normalize(word string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(word) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			b.WriteRune(r)
+		case r == '\'' || r == '’':
+			b.WriteRune('\'')
+		}
+	}
+	w := strings.Trim(b.String(), "'")
+	if !strings.ContainsAny(w, "abcdefghijklmnopqrstuvwxyz") {
+		return ""
+	}
+	return w
+}
+
+// estimate counts the vowel groups in a lowercase word, then corrects for
+// the common silent endings
+func estimate(w string) int {
+	n := 0
+	prevVowel := false
+	for i, r := range w {
+		// y is a vowel except at the start of a word, e.g. yellow
+		vowel := strings.ContainsRune("aeiou", r) || (r == 'y' && i > 0)
+		if vowel && !prevVowel {
+			n++
+		}
+		prevVowel = vowel
+	}
+
+	switch {
+	case n <= 1:
+	// A final e is silent, e.g. stone, but not in a consonant and le, e.g.
+	// little, or a double e, e.g. free
+	case strings.HasSuffix(w, "le"):
+		if len(w) > 2 && isVowel(w[len(w)-3]) {
+			n--
+		}
+	case strings.HasSuffix(w, "e") && !strings.HasSuffix(w, "ee"):
+		n--
+	// -ed is silent unless it follows t or d, e.g. jumped but wanted
+	case strings.HasSuffix(w, "ed") && !strings.HasSuffix(w, "eed"):
+		if stem := w[:len(w)-2]; !strings.HasSuffix(stem, "t") && !strings.HasSuffix(stem, "d") {
+			n--
+		}
+	// -es is silent unless it follows a sibilant, e.g. stones but boxes
+	case strings.HasSuffix(w, "es") && !strings.HasSuffix(w, "ees"):
+		if !sibilant(w[:len(w)-2]) {
+			n--
+		}
+	}
+
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// isVowel reports whether b is a vowel letter
+func isVowel(b byte) bool {
+	return strings.IndexByte("aeiouy", b) >= 0
+}
+
+// sibilant reports whether a stem ends in a sound that -es adds a syllable
+// after
+func sibilant(stem string) bool {
+	for _, end := range []string{"s", "x", "z", "ch", "sh", "c", "g"} {
+		if strings.HasSuffix(stem, end) {
+			return true
+		}
+	}
+	return false
+}
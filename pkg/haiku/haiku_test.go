@@ -0,0 +1,58 @@
+package haiku
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyllables(t *testing.T) {
+	for word, want := range map[string]int{
+		"pond":      1,
+		"the":       1,
+		"stone":     1,
+		"little":    2,
+		"whale":     1,
+		"jumped":    1,
+		"wanted":    2,
+		"stones":    1,
+		"boxes":     2,
+		"free":      1,
+		"agreed":    2,
+		"yellow":    2,
+		"butterfly": 3,
+		"Autumn,":   2,
+		"poem":      2,
+		"poem's":    2,
+		"horse's":   2,
+		"quiet":     2,
+		"don't":     1,
+		"2024":      0,
+		"...":       0,
+	} {
+		require.Equal(t, want, Syllables(word), word)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	a := Analyze("An old silent pond\nA frog jumps into the pond\n\nSplash! Silence again.\n")
+	require.True(t, a.Conforms)
+	require.Equal(t, "5-7-5", a.Pattern)
+	require.Equal(t, []Line{
+		{Text: "An old silent pond", Syllables: 5},
+		{Text: "A frog jumps into the pond", Syllables: 7},
+		{Text: "Splash! Silence again.", Syllables: 5},
+	}, a.Lines)
+
+	// Slashes separate lines written on one line
+	a = Analyze("An old silent pond / A frog jumps into the pond / Splash! Silence again.")
+	require.True(t, a.Conforms)
+
+	a = Analyze("An old silent pond / A frog jumps in the pond / Splash! Silence again.")
+	require.False(t, a.Conforms)
+	require.Equal(t, "5-6-5", a.Pattern)
+
+	a = Analyze("An old silent pond")
+	require.False(t, a.Conforms)
+	require.Equal(t, "5", a.Pattern)
+}
@@ -0,0 +1,63 @@
+// Package requestid carries a per-request ID through contexts, so that log
+// lines from the API and database layers can be tied to the request that
+// caused them.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Header is the HTTP header a request ID is read from and echoed in
+const Header = "X-Request-ID"
+
+// maxLen caps the length of request IDs accepted from clients
+const maxLen = 128
+
+type contextKey struct{}
+
+// New generates a random request ID
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Never fail a request over its ID
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether a client supplied request ID is safe to log and echo:
+// non-empty, not too long, and made of printable ASCII without spaces
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of ctx carrying the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or "" if there is none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Logger returns a log entry tagged with the request ID carried by ctx
+func Logger(ctx context.Context) *log.Entry {
+	if id := FromContext(ctx); id != "" {
+		return log.WithField("request_id", id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}